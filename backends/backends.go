@@ -1,6 +1,14 @@
 package backends
 
-import "fmt"
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
 
 // DummyAuthorizator is a fake authorizator interface implementation used for test
 type DummyAuthorizator struct {
@@ -15,44 +23,25 @@ func (a DummyAuthorizator) Authorize(user, pass string) bool {
 type DummyBackend struct {
 }
 
-// Returns total message count and total mailbox size in bytes (octets).
-// Deleted messages are ignored.
-func (b DummyBackend) Stat(user string) (messages, octets int, err error) {
-	return 5, 50, nil
-}
-
-// List of sizes of all messages in bytes (octets)
+// List of sizes of all messages in bytes (octets). List() and Uidl() are called
+// once after Lock(), message numbers used by client are given by this order.
 func (b DummyBackend) List(user string) (octets []int, err error) {
 	return []int{10, 10, 10, 10, 10}, nil
 }
 
-// Returns whether message exists and if yes, then return size of the message in bytes (octets)
-func (b DummyBackend) ListMessage(user string, msgId int) (exists bool, octets int, err error) {
-	if msgId > 4 {
-		return false, 0, nil
-	}
-	return true, 10, nil
-}
-
 // Retrieve whole message by ID - note that message ID is a message position returned
-// by List() function, so be sure to keep that order unchanged while client is connected
+// by List() function starting at 1, so be sure to keep that order unchanged while client is connected
 // See Lock() function for more details
 func (b DummyBackend) Retr(user string, msgId int) (message string, err error) {
 	return "this is dummy message", nil
 }
 
-// Delete message by message ID - message should be just marked as deleted until
-// Update() is called. Be aware that after Dele() is called, functions like List() etc.
-// should ignore all these messages even if Update() hasn't been called yet
+// Delete message by message ID - Dele() is called when client quits for all messages
+// marked as deleted during the session, Update() is called afterwards
 func (b DummyBackend) Dele(user string, msgId int) error {
 	return nil
 }
 
-// Undelete all messages marked as deleted in single connection
-func (b DummyBackend) Rset(user string) error {
-	return nil
-}
-
 // List of unique IDs of all message, similar to List(), but instead of size there
 // is a unique ID which persists the same across all connections. Uid (unique id) is
 // used to allow client to be able to keep messages on the server.
@@ -60,22 +49,15 @@ func (b DummyBackend) Uidl(user string) (uids []string, err error) {
 	return []string{"1", "2", "3", "4", "5"}, nil
 }
 
-// Similar to ListMessage, but returns unique ID by message ID instead of size.
-func (b DummyBackend) UidlMessage(user string, msgId int) (exists bool, uid string, err error) {
-	if msgId > 4 {
-		return false, "", nil
-	}
-	return true, fmt.Sprintf("%d", msgId+1), nil
-}
-
-// Write all changes to persistent storage, i.e. delete all messages marked as deleted.
+// Write all changes to persistent storage, called after Dele() is called for all deleted messages.
 func (b DummyBackend) Update(user string) error {
 	return nil
 }
 
 // Lock is called immediately after client is connected. The best way what to use Lock() for
 // is to read all the messages into cache after client is connected. If another user
-// tries to lock the storage, you should return an error to avoid data race.
+// tries to lock the storage, you should return an error to avoid data race - preferably
+// popgun.ErrMailboxInUse, so the client is informed by [IN-USE] response code.
 func (b DummyBackend) Lock(user string) error {
 	return nil
 }
@@ -84,3 +66,81 @@ func (b DummyBackend) Lock(user string) error {
 func (b DummyBackend) Unlock(user string) error {
 	return nil
 }
+
+// responseError is an error carrying extended response code (RFC 2449), popgun reports
+// the code to the client as it implements popgun.ResponseCoder. Package popgun can't be
+// imported here, so errors of popgun with the same code and message are matched by Is.
+type responseError struct {
+	code    string
+	message string
+}
+
+func (e *responseError) Error() string {
+	return e.message
+}
+
+func (e *responseError) ResponseCode() string {
+	return e.code
+}
+
+// Is reports whether target carries the same response code and message,
+// so errors.Is(err, popgun.ErrMailboxInUse) holds for ErrMailboxInUse
+func (e *responseError) Is(target error) bool {
+	coder, ok := target.(interface{ ResponseCode() string })
+	return ok && coder.ResponseCode() == e.code && target.Error() == e.message
+}
+
+var (
+	// ErrMailboxInUse is returned by Lock when maildrop is locked by another session,
+	// it matches popgun.ErrMailboxInUse by errors.Is
+	ErrMailboxInUse error = &responseError{"IN-USE", "Mailbox is locked by another session"}
+	// ErrNoSuchMessage is returned when message ID is out of range of List() result
+	ErrNoSuchMessage = errors.New("no such message")
+	// ErrNotLocked is returned when maildrop is accessed without calling Lock first
+	ErrNotLocked = errors.New("maildrop is not locked")
+)
+
+// touchLock updates modification time of lock file held by active session,
+// so it doesn't become stale after timeout
+func touchLock(path string, timeout time.Duration) {
+	if timeout > 0 {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+	}
+}
+
+// crlfSize returns size of message in octets after line endings are normalized to CRLF,
+// which is the size of the message sent to the client
+func crlfSize(r io.Reader) (int, error) {
+	size := 0
+	reader := bufio.NewReader(r)
+	var prev byte
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b == '\n' && prev != '\r' {
+			size++
+		}
+		size++
+		prev = b
+	}
+}
+
+// uidlSafe returns unique ID which can be sent to client - UIDL allows at most 70 characters
+// in range 0x21 to 0x7E (RFC 1939), other IDs are replaced by their hash
+func uidlSafe(uid string) string {
+	valid := len(uid) > 0 && len(uid) <= 70
+	for i := 0; i < len(uid) && valid; i++ {
+		valid = uid[i] >= 0x21 && uid[i] <= 0x7E
+	}
+	if valid {
+		return uid
+	}
+	hash := sha1.Sum([]byte(uid))
+	return hex.EncodeToString(hash[:])
+}
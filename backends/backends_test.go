@@ -0,0 +1,35 @@
+package backends
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestUidlSafe(t *testing.T) {
+	if uid := uidlSafe("1.M1.host,S=10"); uid != "1.M1.host,S=10" {
+		t.Errorf("Expected valid uid to be kept, but got %s", uid)
+	}
+	for _, uid := range []string{strings.Repeat("1", 71), "with space", ""} {
+		if safe := uidlSafe(uid); len(safe) != 40 {
+			t.Errorf("Expected hash of invalid uid %q, but got %s", uid, safe)
+		}
+	}
+}
+
+func TestCrlfSize(t *testing.T) {
+	for message, size := range map[string]int{"": 0, "a\n": 3, "a\r\nb\n": 6, "a\r\n": 3, "\n\n": 4} {
+		if n, err := crlfSize(strings.NewReader(message)); err != nil || n != size {
+			t.Errorf("Expected size %d of %q, but got %d, %v", size, message, n, err)
+		}
+	}
+	if _, err := crlfSize(errorReader{}); err == nil {
+		t.Error("Expected read error")
+	}
+}
+
+type errorReader struct{}
+
+func (errorReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read failed")
+}
@@ -0,0 +1,340 @@
+package backends
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maildirLockFile is created in maildir of the user while it's locked by POP3 session
+const maildirLockFile = "popgun.lock"
+
+// MaildirBackend serves maildrops stored in Maildir format, see https://cr.yp.to/proto/maildir.html.
+// Maildir of every user is a directory named by the user in Root containing new, cur and tmp directories.
+// Message IDs start at 1, so popgun.Config.ZeroBasedMessageIds must not be set.
+type MaildirBackend struct {
+	// Root is a directory containing maildirs of all users
+	Root string
+	// LockTimeout makes lock files older than the timeout stale, e.g. after crash of the server.
+	// Lock file of active session is touched by every backend call, so the timeout must be longer
+	// than clients are idle. Locks never expire if zero.
+	LockTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*maildirSession
+}
+
+// maildirSession is a state of locked maildir
+type maildirSession struct {
+	path     string
+	messages []maildirMessage
+	scanned  bool
+	deleted  map[int]bool
+}
+
+// maildirMessage is a message file in cur directory
+type maildirMessage struct {
+	name string
+	uid  string
+	size int
+}
+
+// NewMaildirBackend creates backend serving maildirs in root directory
+func NewMaildirBackend(root string) *MaildirBackend {
+	return &MaildirBackend{Root: root}
+}
+
+// userDir returns path of user's directory in root, user names must not traverse the root
+func userDir(root, user string) (string, error) {
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\\x00") {
+		return "", fmt.Errorf("invalid user name %q", user)
+	}
+	return filepath.Join(root, user), nil
+}
+
+// Lock creates lock file in maildir of the user, ErrMailboxInUse is returned when it already exists
+func (b *MaildirBackend) Lock(user string) error {
+	path, err := userDir(b.Root, user)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(path, "cur")); err != nil {
+		return fmt.Errorf("maildir of %s not found: %w", user, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sessions[user]; ok {
+		return ErrMailboxInUse
+	}
+	lockPath := filepath.Join(path, maildirLockFile)
+	if b.LockTimeout > 0 {
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > b.LockTimeout {
+			os.Remove(lockPath)
+		}
+	}
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return ErrMailboxInUse
+	}
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(lock, "%d %s\n", os.Getpid(), hostname)
+	lock.Close()
+
+	if b.sessions == nil {
+		b.sessions = make(map[string]*maildirSession)
+	}
+	b.sessions[user] = &maildirSession{path: path, deleted: make(map[int]bool)}
+	return nil
+}
+
+// Unlock removes lock file of the user
+func (b *MaildirBackend) Unlock(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return ErrNotLocked
+	}
+	delete(b.sessions, user)
+	return os.Remove(filepath.Join(session.path, maildirLockFile))
+}
+
+// session returns state of locked maildir and refreshes its lock
+func (b *MaildirBackend) session(user string) (*maildirSession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return nil, ErrNotLocked
+	}
+	touchLock(filepath.Join(session.path, maildirLockFile), b.LockTimeout)
+	return session, nil
+}
+
+// List scans new and cur directories, new messages are moved to cur. Message sizes are taken
+// from W= (size with CRLF line endings) or S= filename hints, message files without hints are read.
+func (b *MaildirBackend) List(user string) ([]int, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.scan(); err != nil {
+		return nil, err
+	}
+	octets := make([]int, len(session.messages))
+	for i, msg := range session.messages {
+		octets[i] = msg.size
+	}
+	return octets, nil
+}
+
+// Uidl returns unique names of message files, which don't change when message is moved or flagged
+func (b *MaildirBackend) Uidl(user string) ([]string, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.scan(); err != nil {
+		return nil, err
+	}
+	uids := make([]string, len(session.messages))
+	for i, msg := range session.messages {
+		uids[i] = msg.uid
+	}
+	return uids, nil
+}
+
+// Retr reads whole message file
+func (b *MaildirBackend) Retr(user string, msgId int) (string, error) {
+	message, err := b.RetrReader(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	defer message.Close()
+	data, err := io.ReadAll(message)
+	return string(data), err
+}
+
+// RetrReader opens message file, so it's streamed to the client
+func (b *MaildirBackend) RetrReader(user string, msgId int) (io.ReadCloser, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := session.message(msgId)
+	if err != nil {
+		return nil, err
+	}
+	return session.open(msg)
+}
+
+// Dele marks message to be deleted by Update
+func (b *MaildirBackend) Dele(user string, msgId int) error {
+	session, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	if _, err := session.message(msgId); err != nil {
+		return err
+	}
+	session.deleted[msgId] = true
+	return nil
+}
+
+// Update removes files of deleted messages
+func (b *MaildirBackend) Update(user string) error {
+	session, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	for msgId := range session.deleted {
+		msg, _ := session.message(msgId)
+		path, err := session.find(msg)
+		if err == nil {
+			err = os.Remove(path)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		delete(session.deleted, msgId)
+	}
+	return nil
+}
+
+// scan reads message files once per session
+func (s *maildirSession) scan() error {
+	if s.scanned {
+		return nil
+	}
+	newEntries, err := os.ReadDir(filepath.Join(s.path, "new"))
+	if err != nil {
+		return err
+	}
+	for _, entry := range newEntries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// messages seen by the client are not new anymore, info is added to the name
+		name := entry.Name()
+		if !strings.Contains(name, ":") {
+			name += ":2,"
+		}
+		err := os.Rename(filepath.Join(s.path, "new", entry.Name()), filepath.Join(s.path, "cur", name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.path, "cur"))
+	if err != nil {
+		return err
+	}
+	s.messages = s.messages[:0]
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		msg := maildirMessage{name: entry.Name()}
+		unique, _, _ := strings.Cut(msg.name, ":")
+		msg.uid = uidlSafe(unique)
+		size, ok := maildirSizeHint(unique)
+		if !ok {
+			size, err = fileCrlfSize(filepath.Join(s.path, "cur", msg.name))
+			if errors.Is(err, os.ErrNotExist) {
+				// deleted by another client meanwhile
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		msg.size = size
+		s.messages = append(s.messages, msg)
+	}
+	// unique names start with delivery time
+	sort.Slice(s.messages, func(i, j int) bool {
+		return s.messages[i].name < s.messages[j].name
+	})
+	s.scanned = true
+	return nil
+}
+
+// maildirSizeHint returns message size from unique name, e.g. "1204680122.M5P2.host,S=1024,W=1048"
+func maildirSizeHint(unique string) (int, bool) {
+	fields := strings.Split(unique, ",")
+	size, ok := -1, false
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch key {
+		case "W":
+			return n, true
+		case "S":
+			size, ok = n, true
+		}
+	}
+	return size, ok
+}
+
+func fileCrlfSize(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return crlfSize(f)
+}
+
+// message returns message by ID starting at 1
+func (s *maildirSession) message(msgId int) (*maildirMessage, error) {
+	if err := s.scan(); err != nil {
+		return nil, err
+	}
+	if msgId < 1 || msgId > len(s.messages) {
+		return nil, ErrNoSuchMessage
+	}
+	return &s.messages[msgId-1], nil
+}
+
+// find returns path of message file, which might have been renamed by another client
+// changing its flags since the maildir was scanned
+func (s *maildirSession) find(msg *maildirMessage) (string, error) {
+	path := filepath.Join(s.path, "cur", msg.name)
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		return path, err
+	}
+	unique, _, _ := strings.Cut(msg.name, ":")
+	entries, err := os.ReadDir(filepath.Join(s.path, "cur"))
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if name := entry.Name(); name == unique || strings.HasPrefix(name, unique+":") {
+			msg.name = name
+			return filepath.Join(s.path, "cur", name), nil
+		}
+	}
+	return "", fmt.Errorf("message %s: %w", unique, os.ErrNotExist)
+}
+
+func (s *maildirSession) open(msg *maildirMessage) (io.ReadCloser, error) {
+	path, err := s.find(msg)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
@@ -0,0 +1,224 @@
+package backends
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// createMaildir creates maildir of the user with given files (relative path, e.g. "new/1.M1.host")
+func createMaildir(t *testing.T, root, user string, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(root, user)
+	for _, dir := range []string{"new", "cur", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(path, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestMaildirBackend_List(t *testing.T) {
+	root := t.TempDir()
+	path := createMaildir(t, root, "john", map[string]string{
+		"new/1700000003.M3P1.host":             "Subject: new\n\nbody\n",
+		"cur/1700000001.M1P1.host,S=20:2,S":    "Subject: hint\n\nbody\n",
+		"cur/1700000002.M2P1.host,S=9,W=99:2,": "ignored",
+		"cur/.hidden":                          "not a message",
+	})
+	backend := NewMaildirBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock("john")
+
+	octets, err := backend.List("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// S= hint, W= preferred to S=, CRLF size of file without hint
+	if expected := []int{20, 99, 22}; !reflect.DeepEqual(octets, expected) {
+		t.Errorf("Expected sizes %v, but got %v", expected, octets)
+	}
+	uids, err := backend.Uidl("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1700000001.M1P1.host,S=20", "1700000002.M2P1.host,S=9,W=99", "1700000003.M3P1.host"}
+	if !reflect.DeepEqual(uids, expected) {
+		t.Errorf("Expected uids %v, but got %v", expected, uids)
+	}
+	if _, err := os.Stat(filepath.Join(path, "cur", "1700000003.M3P1.host:2,")); err != nil {
+		t.Errorf("Expected new message to be moved to cur: %v", err)
+	}
+	if message, err := backend.Retr("john", 3); err != nil || message != "Subject: new\n\nbody\n" {
+		t.Errorf("Expected message, but got '%s', %v", message, err)
+	}
+	if _, err := backend.Retr("john", 4); err != ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+}
+
+func TestMaildirBackend_RetrRenamed(t *testing.T) {
+	root := t.TempDir()
+	path := createMaildir(t, root, "john", map[string]string{"cur/1.M1.host:2,": "message"})
+	backend := NewMaildirBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock("john")
+	if _, err := backend.List("john"); err != nil {
+		t.Fatal(err)
+	}
+	// flagged by another client
+	if err := os.Rename(filepath.Join(path, "cur", "1.M1.host:2,"), filepath.Join(path, "cur", "1.M1.host:2,S")); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := backend.RetrReader("john", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	if message, err := io.ReadAll(reader); err != nil || string(message) != "message" {
+		t.Errorf("Expected renamed message, but got '%s', %v", message, err)
+	}
+}
+
+func TestMaildirBackend_Update(t *testing.T) {
+	root := t.TempDir()
+	path := createMaildir(t, root, "john", map[string]string{
+		"cur/1.M1.host:2,S": "first",
+		"cur/2.M2.host:2,S": "second",
+		"cur/3.M3.host:2,S": "third",
+	})
+	backend := NewMaildirBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List("john"); err != nil {
+		t.Fatal(err)
+	}
+	for _, msgId := range []int{1, 3} {
+		if err := backend.Dele("john", msgId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.Dele("john", 4); err != ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(path, "cur")); len(entries) != 3 {
+		t.Errorf("Expected messages not to be deleted before Update, but got %d files", len(entries))
+	}
+	if err := backend.Update("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Unlock("john"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(path, "cur"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "2.M2.host:2,S" {
+		t.Errorf("Expected only second message to remain, but got %v", entries)
+	}
+}
+
+func TestMaildirBackend_Lock(t *testing.T) {
+	root := t.TempDir()
+	createMaildir(t, root, "john", nil)
+	backend := NewMaildirBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	err := backend.Lock("john")
+	if err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	if coder, ok := err.(interface{ ResponseCode() string }); !ok || coder.ResponseCode() != "IN-USE" {
+		t.Errorf("Expected IN-USE response code, but got %v", err)
+	}
+	// lock file is respected by another server process
+	if err := NewMaildirBackend(root).Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse from another backend, but got %v", err)
+	}
+	if err := backend.Unlock("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Unlock("john"); err != ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+	if _, err := backend.List("john"); err != ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+	if err := backend.Lock("john"); err != nil {
+		t.Errorf("Expected maildir to be locked again, but got %v", err)
+	}
+}
+
+func TestMaildirBackend_LockTimeout(t *testing.T) {
+	root := t.TempDir()
+	path := createMaildir(t, root, "john", map[string]string{maildirLockFile: "1 crashed"})
+	backend := NewMaildirBackend(root)
+	if err := backend.Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	stale := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(path, maildirLockFile), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	backend.LockTimeout = 10 * time.Minute
+	if err := backend.Lock("john"); err != nil {
+		t.Errorf("Expected stale lock to be removed, but got %v", err)
+	}
+
+	// lock of active session is refreshed
+	if err := os.Chtimes(filepath.Join(path, maildirLockFile), stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List("john"); err != nil {
+		t.Fatal(err)
+	}
+	other := &MaildirBackend{Root: root, LockTimeout: backend.LockTimeout}
+	if err := other.Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected lock of active session to be kept, but got %v", err)
+	}
+}
+
+func TestMaildirBackend_LockInvalidUser(t *testing.T) {
+	root := t.TempDir()
+	createMaildir(t, root, "john", nil)
+	backend := NewMaildirBackend(filepath.Join(root, "john"))
+	for _, user := range []string{"", "..", "../john", "cur/..", "jane"} {
+		if err := backend.Lock(user); err == nil {
+			t.Errorf("Expected error for user %q", user)
+		}
+	}
+}
+
+func TestMaildirSizeHint(t *testing.T) {
+	tests := []struct {
+		unique string
+		size   int
+		ok     bool
+	}{
+		{"1.M1.host", 0, false},
+		{"1.M1.host,S=10", 10, true},
+		{"1.M1.host,W=12,S=10", 12, true},
+		{"1.M1.host,S=x", 0, false},
+	}
+	for _, test := range tests {
+		if size, ok := maildirSizeHint(test.unique); ok != test.ok || (ok && size != test.size) {
+			t.Errorf("Expected size %d, %v for %s, but got %d, %v", test.size, test.ok, test.unique, size, ok)
+		}
+	}
+}
@@ -0,0 +1,479 @@
+package backends
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MboxFormat defines how lines starting with "From " are quoted in message bodies
+type MboxFormat int
+
+const (
+	// MboxRD quotes lines matching ">*From " by another ">", quoting is reversible
+	MboxRD MboxFormat = iota
+	// MboxO quotes only lines starting with "From ", so ">From " lines are unquoted as well
+	MboxO
+)
+
+// MboxBackend serves maildrops stored in mbox files, mbox of every user is a file named by the user
+// in Root. Messages are separated by "From " lines preceded by blank line. The mbox is locked by
+// dotlock file (<mbox>.lock) and flock(2) where available, so it can be shared with MDA and other
+// mail clients respecting these locks. Message IDs start at 1, so popgun.Config.ZeroBasedMessageIds
+// must not be set.
+type MboxBackend struct {
+	// Root is a directory containing mbox files of all users
+	Root string
+	// Format is used to unquote "From " lines of message bodies
+	Format MboxFormat
+	// LockTimeout makes dotlock files older than the timeout stale, e.g. after crash of the server.
+	// Dotlock of active session is touched by every backend call, so the timeout must be longer
+	// than clients are idle. Locks never expire if zero.
+	LockTimeout time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*mboxSession
+}
+
+// mboxSession is a state of locked mbox
+type mboxSession struct {
+	path string
+	// file is nil if mbox does not exist, which is an empty maildrop
+	file     *os.File
+	messages []mboxMessage
+	scanned  bool
+	// size of the file when it was scanned
+	size    int64
+	deleted map[int]bool
+}
+
+// mboxMessage is a position of message in mbox file
+type mboxMessage struct {
+	// start is an offset of From_ line, next is an offset of the following message or end of file
+	start, next int64
+	// content is the message without From_ line and blank line separating the following message
+	contentStart, contentEnd int64
+	uid                      string
+	size                     int
+	// pinUid is set when the UID collides with another message, X-UIDL header is written
+	// by rewrite then, so the UID doesn't depend on position of the message among duplicates
+	pinUid bool
+	// crlf is set when From_ line ends with CRLF
+	crlf bool
+}
+
+// NewMboxBackend creates backend serving mbox files in root directory
+func NewMboxBackend(root string) *MboxBackend {
+	return &MboxBackend{Root: root}
+}
+
+// Lock creates dotlock and locks the mbox by flock(2), ErrMailboxInUse is returned
+// when either of them is held by someone else
+func (b *MboxBackend) Lock(user string) error {
+	path, err := userDir(b.Root, user)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sessions[user]; ok {
+		return ErrMailboxInUse
+	}
+	if err := b.dotlock(path); err != nil {
+		return err
+	}
+	session := &mboxSession{path: path, deleted: make(map[int]bool)}
+	if err := session.open(); err != nil {
+		os.Remove(path + ".lock")
+		return err
+	}
+	if b.sessions == nil {
+		b.sessions = make(map[string]*mboxSession)
+	}
+	b.sessions[user] = session
+	return nil
+}
+
+// dotlock creates lock file next to the mbox
+func (b *MboxBackend) dotlock(path string) error {
+	lockPath := path + ".lock"
+	if b.LockTimeout > 0 {
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > b.LockTimeout {
+			os.Remove(lockPath)
+		}
+	}
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return ErrMailboxInUse
+	}
+	if err != nil {
+		return err
+	}
+	// PID in the lock file is read by other mail software
+	fmt.Fprintf(lock, "%d\n", os.Getpid())
+	return lock.Close()
+}
+
+// Unlock releases flock and removes dotlock
+func (b *MboxBackend) Unlock(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return ErrNotLocked
+	}
+	delete(b.sessions, user)
+	session.close()
+	return os.Remove(session.path + ".lock")
+}
+
+// session returns state of locked mbox and refreshes its dotlock
+func (b *MboxBackend) session(user string) (*mboxSession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return nil, ErrNotLocked
+	}
+	touchLock(session.path+".lock", b.LockTimeout)
+	return session, nil
+}
+
+// List returns sizes of messages with CRLF line endings after "From " lines are unquoted
+func (b *MboxBackend) List(user string) ([]int, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.scan(b.Format); err != nil {
+		return nil, err
+	}
+	octets := make([]int, len(session.messages))
+	for i, msg := range session.messages {
+		octets[i] = msg.size
+	}
+	return octets, nil
+}
+
+// Uidl returns X-UIDL header of messages or hash of From_ line and message content if the header
+// is missing
+func (b *MboxBackend) Uidl(user string) ([]string, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := session.scan(b.Format); err != nil {
+		return nil, err
+	}
+	uids := make([]string, len(session.messages))
+	for i, msg := range session.messages {
+		uids[i] = msg.uid
+	}
+	return uids, nil
+}
+
+// Retr reads whole message
+func (b *MboxBackend) Retr(user string, msgId int) (string, error) {
+	message, err := b.RetrReader(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	defer message.Close()
+	data, err := io.ReadAll(message)
+	return string(data), err
+}
+
+// RetrReader returns reader of message content unquoting "From " lines
+func (b *MboxBackend) RetrReader(user string, msgId int) (io.ReadCloser, error) {
+	session, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := session.message(msgId, b.Format)
+	if err != nil {
+		return nil, err
+	}
+	section := io.NewSectionReader(session.file, msg.contentStart, msg.contentEnd-msg.contentStart)
+	return io.NopCloser(&mboxReader{reader: bufio.NewReader(section), format: b.Format}), nil
+}
+
+// Dele marks message to be deleted by Update
+func (b *MboxBackend) Dele(user string, msgId int) error {
+	session, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	if _, err := session.message(msgId, b.Format); err != nil {
+		return err
+	}
+	session.deleted[msgId] = true
+	return nil
+}
+
+// Update rewrites the mbox without deleted messages. The new mbox is written to temporary file,
+// which replaces the original one by rename, so the mbox is never left partially written.
+func (b *MboxBackend) Update(user string) error {
+	session, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	if len(session.deleted) == 0 {
+		return nil
+	}
+	if err := session.rewrite(); err != nil {
+		return err
+	}
+	session.deleted = make(map[int]bool)
+	return nil
+}
+
+// open opens and flocks the mbox file if it exists
+func (s *mboxSession) open() error {
+	file, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := flock(file); err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	return nil
+}
+
+// close releases flock by closing the file
+func (s *mboxSession) close() {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+// message returns message by ID starting at 1
+func (s *mboxSession) message(msgId int, format MboxFormat) (*mboxMessage, error) {
+	if err := s.scan(format); err != nil {
+		return nil, err
+	}
+	if msgId < 1 || msgId > len(s.messages) {
+		return nil, ErrNoSuchMessage
+	}
+	return &s.messages[msgId-1], nil
+}
+
+// scan parses the mbox once per session
+func (s *mboxSession) scan(format MboxFormat) error {
+	if s.scanned {
+		return nil
+	}
+	if s.file != nil {
+		info, err := s.file.Stat()
+		if err != nil {
+			return err
+		}
+		s.size = info.Size()
+		s.messages, err = parseMbox(io.NewSectionReader(s.file, 0, s.size), format)
+		if err != nil {
+			return err
+		}
+	}
+	s.scanned = true
+	return nil
+}
+
+// rewrite replaces the mbox by a copy without deleted messages
+func (s *mboxSession) rewrite() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+filepath.Base(s.path)+".popgun-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := s.copyKept(tmp, info.Size()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	// flock is bound to the replaced file, so the new one is locked until Unlock
+	s.close()
+	s.scanned = false
+	return s.open()
+}
+
+// copyKept writes all data of the mbox except deleted messages, including data appended
+// to the file since it was scanned by software not respecting the locks
+func (s *mboxSession) copyKept(w io.Writer, size int64) error {
+	copyRange := func(start, end int64) error {
+		_, err := io.Copy(w, io.NewSectionReader(s.file, start, end-start))
+		return err
+	}
+	offset := int64(0)
+	for i, msg := range s.messages {
+		switch {
+		case s.deleted[i+1]:
+			if err := copyRange(offset, msg.start); err != nil {
+				return err
+			}
+			offset = msg.next
+		case msg.pinUid:
+			// header follows From_ line, the first X-UIDL header is used as UID
+			if err := copyRange(offset, msg.contentStart); err != nil {
+				return err
+			}
+			eol := "\n"
+			if msg.crlf {
+				eol = "\r\n"
+			}
+			if _, err := io.WriteString(w, "X-UIDL: "+msg.uid+eol); err != nil {
+				return err
+			}
+			offset = msg.contentStart
+		}
+	}
+	return copyRange(offset, size)
+}
+
+// parseMbox finds messages separated by "From " lines, computes their CRLF sizes and UIDs
+func parseMbox(r io.Reader, format MboxFormat) ([]mboxMessage, error) {
+	var messages []mboxMessage
+	reader := bufio.NewReader(r)
+	var offset int64
+	var msg *mboxMessage
+	// indices of messages by UID before suffix is added
+	hash, seen := sha1.New(), map[string][]int{}
+	var inHeaders, prevBlank bool
+	// blank line is added to the message only if it's not followed by the next message
+	var pendingBlank []byte
+
+	finish := func(end int64) {
+		if msg == nil {
+			return
+		}
+		msg.next = end
+		msg.contentEnd = end - int64(len(pendingBlank))
+		if msg.uid == "" {
+			msg.uid = hex.EncodeToString(hash.Sum(nil))
+		}
+		// identical messages get distinct UIDs, which are pinned by X-UIDL header on rewrite
+		uid := msg.uid
+		if dups := seen[uid]; len(dups) > 0 {
+			msg.uid = uidlSafe(uid + "-" + strconv.Itoa(len(dups)+1))
+			msg.pinUid = true
+			messages[dups[0]].pinUid = true
+		}
+		seen[uid] = append(seen[uid], len(messages))
+		messages = append(messages, *msg)
+	}
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if bytes.HasPrefix(line, []byte("From ")) && (offset == 0 || prevBlank) {
+				finish(offset)
+				msg = &mboxMessage{start: offset, contentStart: offset + int64(len(line)),
+					crlf: bytes.HasSuffix(line, []byte("\r\n"))}
+				// From_ line distinguishes identical messages delivered at different times
+				hash.Reset()
+				hash.Write(bytes.TrimRight(line, "\r\n"))
+				hash.Write([]byte("\n"))
+				inHeaders, pendingBlank = true, nil
+			} else if msg != nil {
+				if pendingBlank != nil {
+					msg.size += 2
+					hash.Write([]byte("\n"))
+					pendingBlank = nil
+				}
+				// line endings don't change the hash, so UID is kept when the mbox is rewritten
+				trimmed := bytes.TrimRight(unquoteMboxLine(line, format), "\r\n")
+				if len(trimmed) == 0 {
+					inHeaders = false
+					pendingBlank = line
+				} else {
+					msg.size += len(trimmed) + 2
+					hash.Write(trimmed)
+					hash.Write([]byte("\n"))
+				}
+				if inHeaders && msg.uid == "" && len(trimmed) > 7 && bytes.EqualFold(trimmed[:7], []byte("X-UIDL:")) {
+					msg.uid = uidlSafe(string(bytes.TrimSpace(trimmed[7:])))
+				}
+			}
+			prevBlank = len(bytes.TrimRight(line, "\r\n")) == 0
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			finish(offset)
+			return messages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unquoteMboxLine removes quoting of "From " line in message body
+func unquoteMboxLine(line []byte, format MboxFormat) []byte {
+	if len(line) == 0 || line[0] != '>' {
+		return line
+	}
+	if format == MboxO {
+		if bytes.HasPrefix(line, []byte(">From ")) {
+			return line[1:]
+		}
+		return line
+	}
+	if bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+		return line[1:]
+	}
+	return line
+}
+
+// mboxReader reads message content unquoting "From " lines
+type mboxReader struct {
+	reader *bufio.Reader
+	format MboxFormat
+	buf    []byte
+	err    error
+}
+
+func (r *mboxReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		var line []byte
+		line, r.err = r.reader.ReadBytes('\n')
+		r.buf = unquoteMboxLine(line, r.format)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package backends
+
+import (
+	"os"
+)
+
+// flock is not available, mbox is locked only by dotlock
+func flock(f *os.File) error {
+	return nil
+}
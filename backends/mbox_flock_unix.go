@@ -0,0 +1,18 @@
+//go:build unix
+
+package backends
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// flock locks the file exclusively, ErrMailboxInUse is returned when it's locked by another process
+func flock(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrMailboxInUse
+	}
+	return err
+}
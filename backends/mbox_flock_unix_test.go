@@ -0,0 +1,33 @@
+//go:build unix
+
+package backends
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMboxBackend_LockFlock(t *testing.T) {
+	root, path := createMbox(t, "john", testMbox)
+	// mbox locked by mail client
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flock(f); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewMboxBackend(root)
+	if err := backend.Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Expected dotlock to be removed, but got %v", err)
+	}
+	f.Close()
+	if err := backend.Lock("john"); err != nil {
+		t.Errorf("Expected mbox to be locked after flock is released, but got %v", err)
+	}
+	backend.Unlock("john")
+}
@@ -0,0 +1,316 @@
+package backends
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testMbox = "From alice@example.com Mon Jan  1 00:00:00 2024\n" +
+	"Subject: first\n" +
+	"X-UIDL: uid-1\n" +
+	"\n" +
+	">From the start\n" +
+	">>From quoted twice\n" +
+	"\n" +
+	"From bob@example.com Mon Jan  1 00:00:01 2024\n" +
+	"Subject: second\n" +
+	"\n" +
+	"body\n" +
+	"From is not a separator here\n" +
+	"\n" +
+	"\n" +
+	"From carol@example.com Mon Jan  1 00:00:02 2024\r\n" +
+	"Subject: third\r\n" +
+	"\r\n" +
+	"last"
+
+// createMbox creates mbox of the user in new root directory
+func createMbox(t *testing.T, user, content string) (root, path string) {
+	t.Helper()
+	root = t.TempDir()
+	path = filepath.Join(root, user)
+	if err := os.WriteFile(path, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return root, path
+}
+
+func TestParseMbox(t *testing.T) {
+	tests := []struct {
+		format   MboxFormat
+		messages []string
+	}{
+		{MboxRD, []string{
+			"Subject: first\nX-UIDL: uid-1\n\nFrom the start\n>From quoted twice\n",
+			"Subject: second\n\nbody\nFrom is not a separator here\n\n",
+			"Subject: third\r\n\r\nlast",
+		}},
+		{MboxO, []string{
+			"Subject: first\nX-UIDL: uid-1\n\nFrom the start\n>>From quoted twice\n",
+			"Subject: second\n\nbody\nFrom is not a separator here\n\n",
+			"Subject: third\r\n\r\nlast",
+		}},
+	}
+	for _, test := range tests {
+		messages, err := parseMbox(strings.NewReader(testMbox), test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) != len(test.messages) {
+			t.Fatalf("Expected %d messages, but got %d", len(test.messages), len(messages))
+		}
+		for i, msg := range messages {
+			section := io.NewSectionReader(strings.NewReader(testMbox), msg.contentStart, msg.contentEnd-msg.contentStart)
+			content, _ := io.ReadAll(&mboxReader{reader: bufio.NewReader(section), format: test.format})
+			if string(content) != test.messages[i] {
+				t.Errorf("Expected message %q, but got %q", test.messages[i], content)
+			}
+			// size of the message sent with CRLF line endings
+			size, _ := crlfSize(strings.NewReader(test.messages[i]))
+			if !strings.HasSuffix(test.messages[i], "\n") {
+				size += 2
+			}
+			if msg.size != size {
+				t.Errorf("Expected size %d of message %d, but got %d", size, i+1, msg.size)
+			}
+		}
+		if messages[0].uid != "uid-1" {
+			t.Errorf("Expected uid from X-UIDL header, but got %s", messages[0].uid)
+		}
+		if len(messages[1].uid) != 40 || messages[1].uid == messages[2].uid {
+			t.Errorf("Expected unique content hashes, but got %s and %s", messages[1].uid, messages[2].uid)
+		}
+	}
+}
+
+func TestParseMbox_DuplicateUids(t *testing.T) {
+	message := "From a@example.com Mon Jan  1 00:00:00 2024\nSubject: same\n\nbody\n\n"
+	messages, err := parseMbox(strings.NewReader("garbage\n\n"+message+message+message), MboxRD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 {
+		t.Fatalf("Expected 3 messages, but got %d", len(messages))
+	}
+	uid := messages[0].uid
+	if expected := []string{uid, uid + "-2", uid + "-3"}; messages[1].uid != expected[1] || messages[2].uid != expected[2] {
+		t.Errorf("Expected uids %v, but got %s, %s, %s", expected, messages[0].uid, messages[1].uid, messages[2].uid)
+	}
+
+	// same content delivered at different time
+	other := strings.Replace(message, "00:00:00", "00:00:01", 1)
+	messages, err = parseMbox(strings.NewReader(message+other), MboxRD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].uid == messages[1].uid || strings.Contains(messages[1].uid, "-") || messages[1].pinUid {
+		t.Errorf("Expected From_ line to distinguish messages, but got %s, %s", messages[0].uid, messages[1].uid)
+	}
+}
+
+func TestMboxBackend_DuplicateUids(t *testing.T) {
+	message := "From a@example.com Mon Jan  1 00:00:00 2024\r\nSubject: same\r\n\r\nbody\r\n\r\n"
+	root, _ := createMbox(t, "john", message+message+message)
+	backend := NewMboxBackend(root)
+	backend.Lock("john")
+	uids, err := backend.Uidl("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.Dele("john", 1)
+	if err := backend.Update("john"); err != nil {
+		t.Fatal(err)
+	}
+	backend.Unlock("john")
+
+	// UIDs of the remaining messages are kept, deleted UID is not reused
+	backend.Lock("john")
+	defer backend.Unlock("john")
+	newUids, err := backend.Uidl("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newUids) != 2 || newUids[0] != uids[1] || newUids[1] != uids[2] {
+		t.Errorf("Expected uids %v to be kept, but got %v", uids[1:], newUids)
+	}
+	if content, err := backend.Retr("john", 1); err != nil || content != "X-UIDL: "+uids[1]+"\r\nSubject: same\r\n\r\nbody\r\n" {
+		t.Errorf("Expected X-UIDL header to be added, but got %q, %v", content, err)
+	}
+}
+
+func TestMboxBackend(t *testing.T) {
+	root, path := createMbox(t, "john", testMbox)
+	backend := NewMboxBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	octets, err := backend.List("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(octets) != 3 {
+		t.Fatalf("Expected 3 messages, but got %v", octets)
+	}
+	uids, err := backend.Uidl("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message, err := backend.Retr("john", 3); err != nil || message != "Subject: third\r\n\r\nlast" {
+		t.Errorf("Expected last message, but got %q, %v", message, err)
+	}
+	if _, err := backend.Retr("john", 4); err != ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+
+	if err := backend.Dele("john", 2); err != nil {
+		t.Fatal(err)
+	}
+	// appended by MDA not respecting locks
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("\n\nFrom dave@example.com Mon Jan  1 00:00:03 2024\nSubject: fourth\n\nnew\n")
+	f.Close()
+
+	if err := backend.Update("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Unlock("john"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "Subject: second") || !strings.Contains(string(data), "Subject: fourth") {
+		t.Errorf("Expected second message to be deleted and fourth kept, but got %q", data)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mbox mode to be kept, but got %v", info.Mode())
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("Expected only mbox in root, but got %v", entries)
+	}
+
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock("john")
+	newUids, err := backend.Uidl("john")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(newUids) != 3 || newUids[0] != uids[0] || newUids[1] != uids[2] {
+		t.Errorf("Expected uids to be stable after update, but got %v and %v", uids, newUids)
+	}
+}
+
+func TestMboxBackend_Lock(t *testing.T) {
+	root, path := createMbox(t, "john", testMbox)
+	backend := NewMboxBackend(root)
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("Expected dotlock to be created: %v", err)
+	}
+	// dotlock is respected by another server process
+	if err := NewMboxBackend(root).Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse from another backend, but got %v", err)
+	}
+	if err := backend.Unlock("john"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".lock"); !os.IsNotExist(err) {
+		t.Errorf("Expected dotlock to be removed, but got %v", err)
+	}
+	if err := backend.Unlock("john"); err != ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+}
+
+func TestMboxBackend_LockTimeout(t *testing.T) {
+	root, path := createMbox(t, "john", testMbox)
+	if err := os.WriteFile(path+".lock", []byte("1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stale := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path+".lock", stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	backend := &MboxBackend{Root: root, LockTimeout: 10 * time.Minute}
+	if err := backend.Lock("john"); err != nil {
+		t.Fatalf("Expected stale dotlock to be removed, but got %v", err)
+	}
+	defer backend.Unlock("john")
+
+	// dotlock of active session is refreshed
+	if err := os.Chtimes(path+".lock", stale, stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List("john"); err != nil {
+		t.Fatal(err)
+	}
+	// flock would refuse another session as well, so the dotlock is checked directly
+	info, err := os.Stat(path + ".lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(info.ModTime()) > backend.LockTimeout {
+		t.Errorf("Expected dotlock of active session to be refreshed, but it was modified at %v", info.ModTime())
+	}
+}
+
+func TestMboxBackend_Empty(t *testing.T) {
+	backend := NewMboxBackend(t.TempDir())
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock("john")
+	if octets, err := backend.List("john"); err != nil || len(octets) != 0 {
+		t.Errorf("Expected empty maildrop, but got %v, %v", octets, err)
+	}
+	if err := backend.Update("john"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnquoteMboxLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		format MboxFormat
+		result string
+	}{
+		{">From x\n", MboxRD, "From x\n"},
+		{">>From x\n", MboxRD, ">From x\n"},
+		{">>From x\n", MboxO, ">>From x\n"},
+		{">From x\n", MboxO, "From x\n"},
+		{"> quoted reply\n", MboxRD, "> quoted reply\n"},
+		{"From x\n", MboxRD, "From x\n"},
+	}
+	for _, test := range tests {
+		if result := string(unquoteMboxLine([]byte(test.line), test.format)); result != test.result {
+			t.Errorf("Expected %q, but got %q", test.result, result)
+		}
+	}
+}
+
+func TestMboxBackend_LockInvalidUser(t *testing.T) {
+	backend := NewMboxBackend(t.TempDir())
+	if err := backend.Lock("../john"); err == nil {
+		t.Error("Expected error for invalid user")
+	}
+	if len(backend.sessions) != 0 {
+		t.Error("Expected no session")
+	}
+}
@@ -0,0 +1,259 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MemoryBackend stores maildrops in memory, it's meant for testing of code built on popgun.
+// Messages are delivered by Add or loaded from .eml files. Lock takes snapshot of the maildrop,
+// messages deleted during the session are removed by Update. It's safe for concurrent use.
+type MemoryBackend struct {
+	mu        sync.Mutex
+	maildrops map[string][]memoryMessage
+	sessions  map[string]*memorySession
+	lastId    int
+	lastUid   int
+}
+
+type memoryMessage struct {
+	// id identifies the message in the backend, unlike uid it's never reused
+	id      int
+	uid     string
+	content string
+}
+
+// memorySession is a state of locked maildrop
+type memorySession struct {
+	messages []memoryMessage
+	deleted  map[int]bool
+}
+
+// NewMemoryBackend creates backend with no maildrops
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		maildrops: make(map[string][]memoryMessage),
+		sessions:  make(map[string]*memorySession),
+	}
+}
+
+// Add delivers message to maildrop of the user and returns its unique ID, which is a number
+// not used by other messages of the maildrop
+func (b *MemoryBackend) Add(user, message string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	uid := ""
+	for uid == "" || b.uidExists(user, uid) {
+		b.lastUid++
+		uid = strconv.Itoa(b.lastUid)
+	}
+	b.add(user, uid, message)
+	return uid
+}
+
+// AddDir delivers all .eml files of directory to maildrop of the user in order of their names.
+// File name without extension is used as unique ID of the message, "-n" suffix is appended
+// if it's already used by another message of the maildrop.
+func (b *MemoryBackend) AddDir(user, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	uids := make([]string, 0, len(paths))
+	contents := make([]string, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		uids = append(uids, uidlSafe(strings.TrimSuffix(filepath.Base(path), ".eml")))
+		contents = append(contents, string(content))
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, uid := range uids {
+		unique := uid
+		for n := 2; b.uidExists(user, unique); n++ {
+			unique = uid + "-" + strconv.Itoa(n)
+		}
+		b.add(user, unique, contents[i])
+	}
+	return nil
+}
+
+// add appends message to maildrop of the user, b.mu must be held
+func (b *MemoryBackend) add(user, uid, content string) {
+	b.lastId++
+	b.maildrops[user] = append(b.maildrops[user], memoryMessage{b.lastId, uid, content})
+}
+
+// uidExists returns whether unique ID is used by a message of the maildrop, b.mu must be held
+func (b *MemoryBackend) uidExists(user, uid string) bool {
+	for _, msg := range b.maildrops[user] {
+		if msg.uid == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadFixtures delivers .eml files of every subdirectory of root to maildrop of user named
+// by the subdirectory, e.g. root/john/1.eml is delivered to john, see AddDir
+func (b *MemoryBackend) LoadFixtures(root string) error {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := b.AddDir(entry.Name(), filepath.Join(root, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages returns current content of maildrop of the user, e.g. to check deleted messages
+func (b *MemoryBackend) Messages(user string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	messages := make([]string, len(b.maildrops[user]))
+	for i, msg := range b.maildrops[user] {
+		messages[i] = msg.content
+	}
+	return messages
+}
+
+// Lock takes snapshot of the maildrop, ErrMailboxInUse is returned when it's already locked
+func (b *MemoryBackend) Lock(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sessions[user]; ok {
+		return ErrMailboxInUse
+	}
+	b.sessions[user] = &memorySession{
+		messages: append([]memoryMessage(nil), b.maildrops[user]...),
+		deleted:  make(map[int]bool),
+	}
+	return nil
+}
+
+// Unlock ends the session, messages marked as deleted and not removed by Update are kept
+func (b *MemoryBackend) Unlock(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.sessions[user]; !ok {
+		return ErrNotLocked
+	}
+	delete(b.sessions, user)
+	return nil
+}
+
+// List returns sizes of messages with CRLF line endings
+func (b *MemoryBackend) List(user string) ([]int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return nil, ErrNotLocked
+	}
+	octets := make([]int, len(session.messages))
+	for i, msg := range session.messages {
+		octets[i], _ = crlfSize(strings.NewReader(msg.content))
+	}
+	return octets, nil
+}
+
+// Uidl returns unique IDs of messages
+func (b *MemoryBackend) Uidl(user string) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return nil, ErrNotLocked
+	}
+	uids := make([]string, len(session.messages))
+	for i, msg := range session.messages {
+		uids[i] = msg.uid
+	}
+	return uids, nil
+}
+
+// Retr returns message by ID starting at 1
+func (b *MemoryBackend) Retr(user string, msgId int) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msg, err := b.message(user, msgId)
+	if err != nil {
+		return "", err
+	}
+	return msg.content, nil
+}
+
+// Dele marks message to be deleted by Update
+func (b *MemoryBackend) Dele(user string, msgId int) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.message(user, msgId); err != nil {
+		return err
+	}
+	b.sessions[user].deleted[msgId] = true
+	return nil
+}
+
+// Rset unmarks all messages marked as deleted during the session. popgun handles RSET
+// command by itself, it's available for code using the backend directly.
+func (b *MemoryBackend) Rset(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return ErrNotLocked
+	}
+	session.deleted = make(map[int]bool)
+	return nil
+}
+
+// Update removes messages marked as deleted from the maildrop,
+// messages delivered during the session are kept
+func (b *MemoryBackend) Update(user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, ok := b.sessions[user]
+	if !ok {
+		return ErrNotLocked
+	}
+	deleted := make(map[int]bool)
+	for msgId := range session.deleted {
+		deleted[session.messages[msgId-1].id] = true
+	}
+	var kept []memoryMessage
+	for _, msg := range b.maildrops[user] {
+		if !deleted[msg.id] {
+			kept = append(kept, msg)
+		}
+	}
+	b.maildrops[user] = kept
+	session.deleted = make(map[int]bool)
+	return nil
+}
+
+// message returns message of locked maildrop, b.mu must be held
+func (b *MemoryBackend) message(user string, msgId int) (memoryMessage, error) {
+	session, ok := b.sessions[user]
+	if !ok {
+		return memoryMessage{}, ErrNotLocked
+	}
+	if msgId < 1 || msgId > len(session.messages) {
+		return memoryMessage{}, ErrNoSuchMessage
+	}
+	return session.messages[msgId-1], nil
+}
@@ -0,0 +1,165 @@
+package backends
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	first := backend.Add("john", "Subject: first\n\nbody\n")
+	second := backend.Add("john", "Subject: second\r\n\r\nbody\r\n")
+	backend.Add("jane", "Subject: other user\n\nbody\n")
+
+	if _, err := backend.List("john"); err != ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Lock("john"); err != ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	if err := backend.Lock("jane"); err != nil {
+		t.Errorf("Expected other user to be locked, but got %v", err)
+	}
+
+	if octets, err := backend.List("john"); err != nil || !reflect.DeepEqual(octets, []int{24, 25}) {
+		t.Errorf("Expected CRLF sizes, but got %v, %v", octets, err)
+	}
+	if uids, err := backend.Uidl("john"); err != nil || !reflect.DeepEqual(uids, []string{first, second}) {
+		t.Errorf("Expected uids %s, %s, but got %v, %v", first, second, uids, err)
+	}
+	if message, err := backend.Retr("john", 2); err != nil || message != "Subject: second\r\n\r\nbody\r\n" {
+		t.Errorf("Expected second message, but got %q, %v", message, err)
+	}
+	if _, err := backend.Retr("john", 3); err != ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+
+	// delivered during the session, not visible until next Lock
+	backend.Add("john", "Subject: third\n\nbody\n")
+	if octets, _ := backend.List("john"); len(octets) != 2 {
+		t.Errorf("Expected snapshot of 2 messages, but got %v", octets)
+	}
+
+	backend.Dele("john", 2)
+	backend.Rset("john")
+	backend.Dele("john", 1)
+	if len(backend.Messages("john")) != 3 {
+		t.Error("Expected message not to be deleted before Update")
+	}
+	if err := backend.Update("john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Unlock("john"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Subject: second\r\n\r\nbody\r\n", "Subject: third\n\nbody\n"}
+	if messages := backend.Messages("john"); !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected messages %q, but got %q", expected, messages)
+	}
+	if len(backend.Messages("jane")) != 1 {
+		t.Error("Expected maildrop of other user to be unchanged")
+	}
+}
+
+func TestMemoryBackend_UnlockWithoutUpdate(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.Add("john", "message")
+	backend.Lock("john")
+	backend.Dele("john", 1)
+	backend.Unlock("john")
+	if len(backend.Messages("john")) != 1 {
+		t.Error("Expected message to be kept without Update")
+	}
+	if err := backend.Unlock("john"); err != ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+}
+
+func TestMemoryBackend_LoadFixtures(t *testing.T) {
+	backend := NewMemoryBackend()
+	if err := backend.LoadFixtures("testdata/fixtures"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Lock("john"); err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Unlock("john")
+	if uids, err := backend.Uidl("john"); err != nil || !reflect.DeepEqual(uids, []string{"001-hello", "002-report"}) {
+		t.Errorf("Expected uids from file names, but got %v, %v", uids, err)
+	}
+	// LF line endings are counted as CRLF
+	if octets, err := backend.List("john"); err != nil || !reflect.DeepEqual(octets, []int{78, 99}) {
+		t.Errorf("Expected sizes of fixtures, but got %v, %v", octets, err)
+	}
+	if messages := backend.Messages("jane"); len(messages) != 1 {
+		t.Errorf("Expected 1 message of jane, but got %d", len(messages))
+	}
+	if err := backend.AddDir("john", "testdata/missing"); err != nil {
+		t.Errorf("Expected no messages from missing directory, but got %v", err)
+	}
+	if err := backend.LoadFixtures("testdata/missing"); err == nil {
+		t.Error("Expected error for missing fixtures")
+	}
+}
+
+func TestMemoryBackend_UniqueUids(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "1.eml"), []byte("Subject: fixture\n\nbody\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	backend := NewMemoryBackend()
+	backend.AddDir("john", dir)
+	if uid := backend.Add("john", "Subject: added\n\nbody\n"); uid != "2" {
+		t.Errorf("Expected uid of fixture to be skipped, but got %s", uid)
+	}
+	backend.AddDir("john", dir)
+
+	backend.Lock("john")
+	defer backend.Unlock("john")
+	if uids, err := backend.Uidl("john"); err != nil || !reflect.DeepEqual(uids, []string{"1", "2", "1-2"}) {
+		t.Errorf("Expected unique uids, but got %v, %v", uids, err)
+	}
+	// only the message itself is deleted, not other messages of the same content
+	backend.Dele("john", 1)
+	if err := backend.Update("john"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"Subject: added\n\nbody\n", "Subject: fixture\n\nbody\n"}
+	if messages := backend.Messages("john"); !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Expected messages %q, but got %q", expected, messages)
+	}
+}
+
+func TestMemoryBackend_Concurrent(t *testing.T) {
+	backend := NewMemoryBackend()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backend.Add("john", "message")
+			if err := backend.Lock("john"); err == nil {
+				backend.List("john")
+				backend.Dele("john", 1)
+				backend.Update("john")
+				backend.Unlock("john")
+			}
+		}()
+	}
+	wg.Wait()
+	uids := make(map[string]bool)
+	backend.Lock("john")
+	list, _ := backend.Uidl("john")
+	for _, uid := range list {
+		if uids[uid] {
+			t.Errorf("Expected unique uids, but got %v", list)
+		}
+		uids[uid] = true
+	}
+}
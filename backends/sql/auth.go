@@ -0,0 +1,147 @@
+package sql
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// Authorizator verifies passwords against hashes stored in SQL database,
+// it implements popgun.AuthorizatorV2
+type Authorizator struct {
+	DB *sql.DB
+	// Query selects password hash of the user (argument),
+	// e.g. "SELECT password FROM users WHERE name = $1"
+	Query string
+	// Verify checks password against the hash, VerifyPassword is used if nil.
+	// Set it to support other schemes, e.g. bcrypt.
+	Verify func(hash, password string) bool
+}
+
+// NewAuthorizator creates authorizator using given database and query
+func NewAuthorizator(db *sql.DB, query string) *Authorizator {
+	return &Authorizator{DB: db, Query: query}
+}
+
+// Authorize checks password of the user, database errors are returned,
+// so they are distinguished from invalid password
+func (a *Authorizator) Authorize(ctx context.Context, user, pass string) (bool, error) {
+	var hash string
+	err := a.DB.QueryRowContext(ctx, a.Query, user).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	verify := a.Verify
+	if verify == nil {
+		verify = VerifyPassword
+	}
+	return verify(hash, pass), nil
+}
+
+// VerifyPassword checks password against hash in one of supported schemes - salted or plain
+// SHA-2 hashes used by Dovecot ({SSHA256}, {SSHA512}, {SHA256}, {SHA512} followed by base64
+// encoded hash and salt), PBKDF2 hashes of passlib ($pbkdf2-sha256$rounds$salt$hash and
+// $pbkdf2-sha512$...) and {PLAIN} passwords.
+func VerifyPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$pbkdf2-") {
+		return verifyPbkdf2(hash, password)
+	}
+	scheme, encoded, ok := strings.Cut(strings.TrimPrefix(hash, "{"), "}")
+	if !ok || !strings.HasPrefix(hash, "{") {
+		return false
+	}
+	switch strings.ToUpper(scheme) {
+	case "PLAIN":
+		return subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) == 1
+	case "SHA256":
+		return verifySalted(sha256.New, encoded, password, false)
+	case "SSHA256":
+		return verifySalted(sha256.New, encoded, password, true)
+	case "SHA512":
+		return verifySalted(sha512.New, encoded, password, false)
+	case "SSHA512":
+		return verifySalted(sha512.New, encoded, password, true)
+	}
+	return false
+}
+
+// verifySalted checks base64 encoded digest of password followed by salt
+func verifySalted(newHash func() hash.Hash, encoded, password string, salted bool) bool {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	h := newHash()
+	if len(decoded) < h.Size() || (!salted && len(decoded) != h.Size()) {
+		return false
+	}
+	digest, salt := decoded[:h.Size()], decoded[h.Size():]
+	h.Write([]byte(password))
+	h.Write(salt)
+	return subtle.ConstantTimeCompare(h.Sum(nil), digest) == 1
+}
+
+// verifyPbkdf2 checks passlib hash, salt and hash are encoded by base64 with "." instead of "+"
+func verifyPbkdf2(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return false
+	}
+	var newHash func() hash.Hash
+	switch parts[1] {
+	case "pbkdf2-sha256":
+		newHash = sha256.New
+	case "pbkdf2-sha512":
+		newHash = sha512.New
+	default:
+		return false
+	}
+	rounds, err := strconv.Atoi(parts[2])
+	if err != nil || rounds < 1 {
+		return false
+	}
+	salt, err1 := decodeAb64(parts[3])
+	digest, err2 := decodeAb64(parts[4])
+	if err1 != nil || err2 != nil || len(digest) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2(newHash, []byte(password), salt, rounds, len(digest)), digest) == 1
+}
+
+func decodeAb64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.ReplaceAll(s, ".", "+"))
+}
+
+// pbkdf2 derives key according to RFC 8018 section 5.2
+func pbkdf2(newHash func() hash.Hash, password, salt []byte, rounds, keyLen int) []byte {
+	prf := hmac.New(newHash, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < rounds; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
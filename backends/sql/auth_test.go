@@ -0,0 +1,103 @@
+package sql
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestAuthorizator(t *testing.T) {
+	fake, db := newFakeDB(t)
+	fake.passwords["john"] = "{PLAIN}secret"
+	fake.passwords["jane"] = ssha256("secret", "salt")
+	authorizator := NewAuthorizator(db, "password $1")
+	ctx := context.Background()
+
+	tests := []struct {
+		user, pass string
+		ok         bool
+	}{
+		{"john", "secret", true},
+		{"john", "wrong", false},
+		{"jane", "secret", true},
+		{"jane", "wrong", false},
+		{"unknown", "secret", false},
+	}
+	for _, test := range tests {
+		if ok, err := authorizator.Authorize(ctx, test.user, test.pass); ok != test.ok || err != nil {
+			t.Errorf("Expected %v for %s/%s, but got %v, %v", test.ok, test.user, test.pass, ok, err)
+		}
+	}
+
+	authorizator.Verify = func(hash, password string) bool {
+		return hash == "{PLAIN}"+strings.ToLower(password)
+	}
+	if ok, _ := authorizator.Authorize(ctx, "john", "SECRET"); !ok {
+		t.Error("Expected custom Verify to be used")
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if ok, err := authorizator.Authorize(cancelled, "john", "secret"); ok || err != context.Canceled {
+		t.Errorf("Expected context error, but got %v, %v", ok, err)
+	}
+
+	authorizator.Query = "unknown"
+	if ok, err := authorizator.Authorize(ctx, "john", "secret"); ok || err == nil {
+		t.Errorf("Expected database error, but got %v, %v", ok, err)
+	}
+}
+
+func ssha256(password, salt string) string {
+	digest := sha256.Sum256([]byte(password + salt))
+	return "{SSHA256}" + base64.StdEncoding.EncodeToString(append(digest[:], salt...))
+}
+
+func ab64(data []byte) string {
+	return strings.ReplaceAll(base64.RawStdEncoding.EncodeToString(data), "+", ".")
+}
+
+func TestVerifyPassword(t *testing.T) {
+	sha512Digest := sha512.Sum512([]byte("password"))
+	// RFC 7914 section 11 test vector of PBKDF2-HMAC-SHA256
+	rfcKey, _ := hex.DecodeString("55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783")
+	tests := []struct {
+		hash string
+		ok   bool
+	}{
+		{"{PLAIN}password", true},
+		{"{plain}password", true},
+		{"{PLAIN}other", false},
+		{ssha256("password", "NaCl"), true},
+		{ssha256("other", "NaCl"), false},
+		{"{SHA512}" + base64.StdEncoding.EncodeToString(sha512Digest[:]), true},
+		{"{SSHA512}" + base64.StdEncoding.EncodeToString(sha512Digest[:]), true},
+		{"{SHA256}" + base64.StdEncoding.EncodeToString(sha512Digest[:]), false},
+		{"{SHA256}not base64", false},
+		{"$pbkdf2-sha256$1$" + ab64([]byte("salt")) + "$" + ab64(pbkdf2(sha256.New, []byte("password"), []byte("salt"), 1, 32)), true},
+		{"$pbkdf2-sha256$0$c2FsdA$AAAA", false},
+		{"$pbkdf2-md5$1$c2FsdA$AAAA", false},
+		{"$pbkdf2-sha256$1$c2FsdA", false},
+		{"{MD5}X03MO1qnZdYdgyfeuILPmQ==", false},
+		{"password", false},
+	}
+	for _, test := range tests {
+		if ok := VerifyPassword(test.hash, "password"); ok != test.ok {
+			t.Errorf("Expected %v for hash %s, but got %v", test.ok, test.hash, ok)
+		}
+	}
+
+	// key longer than single block of hash
+	if key := pbkdf2(sha256.New, []byte("passwd"), []byte("salt"), 1, 64); hex.EncodeToString(key) != hex.EncodeToString(rfcKey) {
+		t.Errorf("Expected RFC 7914 test vector, but got %x", key)
+	}
+	passlib := "$pbkdf2-sha256$1$" + ab64([]byte("salt")) + "$" + ab64(rfcKey)
+	if !VerifyPassword(passlib, "passwd") {
+		t.Error("Expected passlib hash with 64 bytes key to be verified")
+	}
+}
@@ -0,0 +1,263 @@
+package sql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDriver is database/sql driver serving fixed queries over in-memory fakeDB:
+//
+//	password $1  - password hash of user
+//	lock $1      - boolean advisory lock of user held until end of transaction
+//	lock-int $1  - integer variant of the lock
+//	lock-error   - fails with errLockNotAvailable
+//	list $1      - id, uid and size of messages of user
+//	retr $1      - content of message by id
+//	delete $1    - deletes message by id when transaction is committed
+type fakeDriver struct{}
+
+var (
+	fakeDBsMu sync.Mutex
+	fakeDBs   = make(map[string]*fakeDB)
+
+	errLockNotAvailable = errors.New("could not obtain lock")
+)
+
+func init() {
+	sql.Register("popgun-fake", fakeDriver{})
+}
+
+type fakeMessage struct {
+	id      int64
+	owner   string
+	uid     string
+	content string
+}
+
+type fakeDB struct {
+	mu        sync.Mutex
+	passwords map[string]string
+	messages  []fakeMessage
+	locks     map[string]*fakeTx
+	// failDelete makes delete of message with the id fail
+	failDelete int64
+}
+
+// newFakeDB registers empty database of the test and opens it
+func newFakeDB(t *testing.T) (*fakeDB, *sql.DB) {
+	fake := &fakeDB{passwords: make(map[string]string), locks: make(map[string]*fakeTx)}
+	fakeDBsMu.Lock()
+	fakeDBs[t.Name()] = fake
+	fakeDBsMu.Unlock()
+	db, err := sql.Open("popgun-fake", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return fake, db
+}
+
+func (d *fakeDB) add(owner, uid, content string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = append(d.messages, fakeMessage{int64(len(d.messages) + 1), owner, uid, content})
+}
+
+func (d *fakeDB) contents(owner string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var contents []string
+	for _, msg := range d.messages {
+		if msg.owner == owner {
+			contents = append(contents, msg.content)
+		}
+	}
+	return contents
+}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fakeDBsMu.Lock()
+	defer fakeDBsMu.Unlock()
+	db, ok := fakeDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %s", name)
+	}
+	return &fakeConn{db: db}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+	tx *fakeTx
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: strings.Fields(query)[0]}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+type fakeTx struct {
+	conn    *fakeConn
+	deleted []int64
+}
+
+func (tx *fakeTx) Commit() error {
+	db := tx.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var kept []fakeMessage
+	for _, msg := range db.messages {
+		if !containsId(tx.deleted, msg.id) {
+			kept = append(kept, msg)
+		}
+	}
+	db.messages = kept
+	tx.end()
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.conn.db.mu.Lock()
+	defer tx.conn.db.mu.Unlock()
+	tx.end()
+	return nil
+}
+
+// end releases locks held by transaction, db.mu must be held
+func (tx *fakeTx) end() {
+	for user, holder := range tx.conn.db.locks {
+		if holder == tx {
+			delete(tx.conn.db.locks, user)
+		}
+	}
+	tx.conn.tx = nil
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.query != "delete" {
+		return nil, fmt.Errorf("unknown statement %s", s.query)
+	}
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	id := args[0].(int64)
+	if id == db.failDelete {
+		return nil, errors.New("delete failed")
+	}
+	if s.conn.tx == nil {
+		return nil, errors.New("delete outside of transaction")
+	}
+	s.conn.tx.deleted = append(s.conn.tx.deleted, id)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := s.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := &fakeRows{}
+	switch s.query {
+	case "password":
+		rows.columns = []string{"password"}
+		if hash, ok := db.passwords[args[0].(string)]; ok {
+			rows.values = [][]driver.Value{{hash}}
+		}
+	case "lock", "lock-int":
+		user := args[0].(string)
+		holder, held := db.locks[user]
+		locked := !held || holder == s.conn.tx
+		if locked {
+			db.locks[user] = s.conn.tx
+		}
+		rows.columns = []string{"locked"}
+		if s.query == "lock-int" {
+			value := int64(0)
+			if locked {
+				value = 1
+			}
+			rows.values = [][]driver.Value{{value}}
+		} else {
+			rows.values = [][]driver.Value{{locked}}
+		}
+	case "lock-error":
+		return nil, errLockNotAvailable
+	case "list":
+		rows.columns = []string{"id", "uid", "size"}
+		for _, msg := range db.messages {
+			if msg.owner == args[0].(string) {
+				rows.values = append(rows.values, []driver.Value{msg.id, msg.uid, int64(len(msg.content))})
+			}
+		}
+		sort.Slice(rows.values, func(i, j int) bool {
+			return rows.values[i][0].(int64) < rows.values[j][0].(int64)
+		})
+	case "retr":
+		rows.columns = []string{"content"}
+		for _, msg := range db.messages {
+			if msg.id == args[0].(int64) {
+				rows.values = [][]driver.Value{{msg.content}}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown query %s", s.query)
+	}
+	return rows, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,260 @@
+// Package sql provides Backend and Authorizator storing maildrops in SQL database
+// accessed by database/sql with any driver. Queries are configurable, so they can
+// be adapted to existing schema and placeholder syntax of the driver.
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// Queries are SQL statements used by Backend, placeholders depend on the driver
+// (e.g. $1 for PostgreSQL, ? for MySQL). All of them are executed in transaction
+// of the session, which is started by Lock.
+type Queries struct {
+	// Lock locks maildrop of the user (argument) until the transaction ends and returns single row,
+	// e.g. "SELECT id FROM users WHERE name = $1 FOR UPDATE NOWAIT" or advisory lock
+	// "SELECT pg_try_advisory_xact_lock(hashtext($1))". Boolean false or integer 0 in the first
+	// column means the maildrop is locked by another session. Maildrop is not locked if empty.
+	Lock string
+	// List selects messages of the user (argument) ordered by delivery - columns are message
+	// identifier (passed to Retr and Delete), unique ID used by UIDL and size in octets,
+	// e.g. "SELECT id, uid, size FROM messages WHERE owner = $1 ORDER BY id"
+	List string
+	// Retr selects content of message by its identifier (argument),
+	// e.g. "SELECT content FROM messages WHERE id = $1"
+	Retr string
+	// Delete deletes message by its identifier (argument), e.g. "DELETE FROM messages WHERE id = $1"
+	Delete string
+}
+
+// Backend serves maildrops stored in SQL database, it implements popgun.BackendV2, so queries
+// are cancelled when the client disconnects. Lock starts transaction, which is held during
+// the whole session and rolled back if the client disconnects without QUIT. Messages deleted
+// during the session are deleted by Update in the same transaction, which is committed then,
+// so either all or none of them are deleted. Message IDs start at 1, so
+// popgun.Config.ZeroBasedMessageIds must not be set.
+type Backend struct {
+	DB      *sql.DB
+	Queries Queries
+	// InUse returns whether error of Lock query means the maildrop is locked by another session,
+	// e.g. PostgreSQL lock_not_available error caused by NOWAIT. Such error is reported
+	// as backends.ErrMailboxInUse.
+	InUse func(err error) bool
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session is a transaction of locked maildrop
+type session struct {
+	tx       *sql.Tx
+	ids      []interface{}
+	uids     []string
+	sizes    []int
+	listed   bool
+	deleted  map[int]bool
+	finished bool
+}
+
+// NewBackend creates backend using given database and queries
+func NewBackend(db *sql.DB, queries Queries) *Backend {
+	return &Backend{DB: db, Queries: queries}
+}
+
+// Lock starts transaction of the session and locks the maildrop by Lock query,
+// the transaction is rolled back when ctx is cancelled
+func (b *Backend) Lock(ctx context.Context, user string) error {
+	b.mu.Lock()
+	if _, ok := b.sessions[user]; ok {
+		b.mu.Unlock()
+		return backends.ErrMailboxInUse
+	}
+	if b.sessions == nil {
+		b.sessions = make(map[string]*session)
+	}
+	// session is reserved, so Lock query waiting for the lock doesn't block other users
+	s := &session{deleted: make(map[int]bool)}
+	b.sessions[user] = s
+	b.mu.Unlock()
+
+	tx, err := b.begin(ctx, user)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		delete(b.sessions, user)
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+// begin starts transaction locking maildrop of the user
+func (b *Backend) begin(ctx context.Context, user string) (*sql.Tx, error) {
+	tx, err := b.DB.BeginTx(ctx, nil)
+	if err != nil || b.Queries.Lock == "" {
+		return tx, err
+	}
+	var locked interface{}
+	err = tx.QueryRowContext(ctx, b.Queries.Lock, user).Scan(&locked)
+	if err == nil && (locked == false || locked == int64(0)) {
+		err = backends.ErrMailboxInUse
+	} else if err != nil && b.InUse != nil && b.InUse(err) {
+		err = backends.ErrMailboxInUse
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Unlock ends the session, transaction is rolled back unless it was committed by Update
+func (b *Backend) Unlock(ctx context.Context, user string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[user]
+	if !ok || s.tx == nil {
+		return backends.ErrNotLocked
+	}
+	delete(b.sessions, user)
+	if s.finished {
+		return nil
+	}
+	err := s.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		// already rolled back when context of the session was cancelled
+		return nil
+	}
+	return err
+}
+
+// session returns transaction of locked maildrop, which is not finished yet
+func (b *Backend) session(user string) (*session, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sessions[user]
+	if !ok || s.tx == nil || s.finished {
+		return nil, backends.ErrNotLocked
+	}
+	return s, nil
+}
+
+// List returns sizes of messages selected by List query
+func (b *Backend) List(ctx context.Context, user string) ([]int, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.list(ctx, b.Queries.List, user); err != nil {
+		return nil, err
+	}
+	return s.sizes, nil
+}
+
+// Uidl returns unique IDs of messages selected by List query
+func (b *Backend) Uidl(ctx context.Context, user string) ([]string, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.list(ctx, b.Queries.List, user); err != nil {
+		return nil, err
+	}
+	return s.uids, nil
+}
+
+// Retr returns content of message selected by Retr query
+func (b *Backend) Retr(ctx context.Context, user string, msgId int) (string, error) {
+	s, err := b.session(user)
+	if err != nil {
+		return "", err
+	}
+	id, err := s.id(ctx, b.Queries.List, user, msgId)
+	if err != nil {
+		return "", err
+	}
+	var message string
+	err = s.tx.QueryRowContext(ctx, b.Queries.Retr, id).Scan(&message)
+	return message, err
+}
+
+// Dele marks message to be deleted by Update
+func (b *Backend) Dele(ctx context.Context, user string, msgId int) error {
+	s, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	if _, err := s.id(ctx, b.Queries.List, user, msgId); err != nil {
+		return err
+	}
+	s.deleted[msgId] = true
+	return nil
+}
+
+// Update deletes messages by Delete query and commits the transaction, which releases the lock.
+// The transaction is rolled back if any of the messages can't be deleted.
+func (b *Backend) Update(ctx context.Context, user string) error {
+	s, err := b.session(user)
+	if err != nil {
+		return err
+	}
+	msgIds := make([]int, 0, len(s.deleted))
+	for msgId := range s.deleted {
+		msgIds = append(msgIds, msgId)
+	}
+	sort.Ints(msgIds)
+	s.finished = true
+	for _, msgId := range msgIds {
+		if _, err := s.tx.ExecContext(ctx, b.Queries.Delete, s.ids[msgId-1]); err != nil {
+			s.tx.Rollback()
+			return err
+		}
+	}
+	return s.tx.Commit()
+}
+
+// list selects messages once per session
+func (s *session) list(ctx context.Context, query, user string) error {
+	if s.listed {
+		return nil
+	}
+	rows, err := s.tx.QueryContext(ctx, query, user)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	s.ids, s.uids, s.sizes = nil, nil, nil
+	for rows.Next() {
+		var id interface{}
+		var uid string
+		var size int
+		if err := rows.Scan(&id, &uid, &size); err != nil {
+			return err
+		}
+		s.ids = append(s.ids, id)
+		s.uids = append(s.uids, uid)
+		s.sizes = append(s.sizes, size)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	s.listed = true
+	return nil
+}
+
+// id returns database identifier of message by ID starting at 1
+func (s *session) id(ctx context.Context, query, user string, msgId int) (interface{}, error) {
+	if err := s.list(ctx, query, user); err != nil {
+		return nil, err
+	}
+	if msgId < 1 || msgId > len(s.ids) {
+		return nil, backends.ErrNoSuchMessage
+	}
+	return s.ids[msgId-1], nil
+}
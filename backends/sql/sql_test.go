@@ -0,0 +1,213 @@
+package sql
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DevelHell/popgun"
+	"github.com/DevelHell/popgun/backends"
+)
+
+var (
+	_ popgun.BackendV2      = (*Backend)(nil)
+	_ popgun.AuthorizatorV2 = (*Authorizator)(nil)
+)
+
+var testQueries = Queries{
+	Lock:   "lock $1",
+	List:   "list $1",
+	Retr:   "retr $1",
+	Delete: "delete $1",
+}
+
+func TestBackend(t *testing.T) {
+	ctx := context.Background()
+	fake, db := newFakeDB(t)
+	fake.add("john", "uid-1", "first")
+	fake.add("jane", "uid-2", "other user")
+	fake.add("john", "uid-3", "third")
+	fake.add("john", "uid-4", "fourth")
+	backend := NewBackend(db, testQueries)
+
+	if _, err := backend.List(ctx, "john"); err != backends.ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+	if err := backend.Lock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if octets, err := backend.List(ctx, "john"); err != nil || !reflect.DeepEqual(octets, []int{5, 5, 6}) {
+		t.Errorf("Expected sizes of messages, but got %v, %v", octets, err)
+	}
+	if uids, err := backend.Uidl(ctx, "john"); err != nil || !reflect.DeepEqual(uids, []string{"uid-1", "uid-3", "uid-4"}) {
+		t.Errorf("Expected uids of messages, but got %v, %v", uids, err)
+	}
+	if message, err := backend.Retr(ctx, "john", 2); err != nil || message != "third" {
+		t.Errorf("Expected third message, but got '%s', %v", message, err)
+	}
+	if _, err := backend.Retr(ctx, "john", 4); err != backends.ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+	for _, msgId := range []int{3, 1} {
+		if err := backend.Dele(ctx, "john", msgId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.Dele(ctx, "john", 0); err != backends.ErrNoSuchMessage {
+		t.Errorf("Expected ErrNoSuchMessage, but got %v", err)
+	}
+	if len(fake.contents("john")) != 3 {
+		t.Error("Expected messages not to be deleted before Update")
+	}
+	if err := backend.Update(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List(ctx, "john"); err != backends.ErrNotLocked {
+		t.Errorf("Expected transaction to be finished by Update, but got %v", err)
+	}
+	if err := backend.Unlock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if contents := fake.contents("john"); !reflect.DeepEqual(contents, []string{"third"}) {
+		t.Errorf("Expected only third message to remain, but got %v", contents)
+	}
+	if len(fake.contents("jane")) != 1 {
+		t.Error("Expected maildrop of other user to be unchanged")
+	}
+}
+
+func TestBackend_Rollback(t *testing.T) {
+	ctx := context.Background()
+	fake, db := newFakeDB(t)
+	fake.add("john", "uid-1", "first")
+	fake.add("john", "uid-2", "second")
+	backend := NewBackend(db, testQueries)
+
+	// session ended without Update
+	backend.Lock(ctx, "john")
+	backend.Dele(ctx, "john", 1)
+	if err := backend.Unlock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.contents("john")) != 2 {
+		t.Error("Expected messages to be kept without Update")
+	}
+
+	// none of the messages is deleted when one of them fails
+	fake.failDelete = 2
+	backend.Lock(ctx, "john")
+	backend.Dele(ctx, "john", 1)
+	backend.Dele(ctx, "john", 2)
+	if err := backend.Update(ctx, "john"); err == nil {
+		t.Error("Expected Update to fail")
+	}
+	if err := backend.Unlock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.contents("john")) != 2 {
+		t.Error("Expected transaction to be rolled back")
+	}
+	if err := backend.Unlock(ctx, "john"); err != backends.ErrNotLocked {
+		t.Errorf("Expected ErrNotLocked, but got %v", err)
+	}
+}
+
+func TestBackend_Lock(t *testing.T) {
+	ctx := context.Background()
+	_, db := newFakeDB(t)
+	backend := NewBackend(db, testQueries)
+	if err := backend.Lock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Lock(ctx, "john"); err != backends.ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse, but got %v", err)
+	}
+	// lock in database is respected by another server process
+	other := NewBackend(db, testQueries)
+	err := other.Lock(ctx, "john")
+	if err != backends.ErrMailboxInUse {
+		t.Errorf("Expected ErrMailboxInUse from another backend, but got %v", err)
+	}
+	if coder, ok := err.(interface{ ResponseCode() string }); !ok || coder.ResponseCode() != "IN-USE" {
+		t.Errorf("Expected IN-USE response code, but got %v", err)
+	}
+	if !errors.Is(err, popgun.ErrMailboxInUse) {
+		t.Errorf("Expected popgun.ErrMailboxInUse, but got %v", err)
+	}
+	if err := other.Lock(ctx, "jane"); err != nil {
+		t.Errorf("Expected other user to be locked, but got %v", err)
+	}
+	if err := backend.Unlock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Lock(ctx, "john"); err != nil {
+		t.Errorf("Expected lock to be released by Unlock, but got %v", err)
+	}
+}
+
+func TestBackend_LockQueries(t *testing.T) {
+	ctx := context.Background()
+	_, db := newFakeDB(t)
+	holder := NewBackend(db, testQueries)
+	if err := holder.Lock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Unlock(ctx, "john")
+
+	tests := []struct {
+		queries Queries
+		inUse   func(error) bool
+		err     error
+	}{
+		{Queries{Lock: "lock-int $1"}, nil, backends.ErrMailboxInUse},
+		{Queries{Lock: "lock-error"}, nil, errLockNotAvailable},
+		{Queries{Lock: "lock-error"}, func(err error) bool { return errors.Is(err, errLockNotAvailable) }, backends.ErrMailboxInUse},
+		{Queries{}, nil, nil},
+	}
+	for _, test := range tests {
+		backend := NewBackend(db, test.queries)
+		backend.InUse = test.inUse
+		if err := backend.Lock(ctx, "john"); err != test.err {
+			t.Errorf("Expected %v for %+v, but got %v", test.err, test.queries, err)
+		}
+		if test.err != nil && len(backend.sessions) != 0 {
+			t.Errorf("Expected no session after failed Lock")
+		}
+	}
+}
+
+func TestBackend_Cancel(t *testing.T) {
+	fake, db := newFakeDB(t)
+	fake.add("john", "uid-1", "first")
+	backend := NewBackend(db, testQueries)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := backend.Lock(ctx, "john"); err != nil {
+		t.Fatal(err)
+	}
+	backend.Dele(ctx, "john", 1)
+	cancel()
+	if _, err := backend.Retr(ctx, "john", 1); err == nil {
+		t.Error("Expected query to fail with cancelled context")
+	}
+
+	// transaction is rolled back, so the lock is released for other sessions
+	other := NewBackend(db, testQueries)
+	var err error
+	for i := 0; i < 100; i++ {
+		if err = other.Lock(context.Background(), "john"); err != backends.ErrMailboxInUse {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("Expected lock to be released after cancel, but got %v", err)
+	}
+	if err := backend.Unlock(context.Background(), "john"); err != nil {
+		t.Errorf("Expected Unlock of rolled back session to succeed, but got %v", err)
+	}
+	if len(fake.contents("john")) != 1 {
+		t.Error("Expected message to be kept")
+	}
+}
@@ -1,7 +1,14 @@
 package popgun
 
 import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -10,19 +17,32 @@ type Executable interface {
 	Run(c *Client, args []string) (int, error)
 }
 
+// Capable is an optional interface of Executable. Capabilities of all commands
+// available to the client are listed in CAPA response (RFC 2449).
+type Capable interface {
+	Capabilities(c *Client) []string
+}
+
 type QuitCommand struct{}
 
 func (cmd QuitCommand) Run(c *Client, args []string) (int, error) {
 	newState := c.currentState
 	if c.currentState == STATE_TRANSACTION {
-		err := c.backend.Update(c.user)
+		err := c.update()
 		if err != nil {
-			return 0, fmt.Errorf("Error updating maildrop for user %s: %v", c.user, err)
+			// session ends anyway (RFC 1939 section 6), the maildrop is unlocked
+			// without update when the connection is closed
+			log.Printf("Error updating maildrop for user %s: %v", c.user, err)
+			c.printer.ErrCode(responseCode(err), "Some deleted messages not removed")
+			c.isAlive = false
+			return STATE_TRANSACTION, nil
 		}
-		err = c.backend.Unlock(c.user)
+		err = c.backend.Unlock(c.ctx, c.user)
 		if err != nil {
+			log.Printf("Error unlocking maildrop for user %s: %v", c.user, err)
 			c.printer.Err("Server was unable to unlock maildrop")
-			return 0, fmt.Errorf("Error unlocking maildrop for user %s: %v", c.user, err)
+			c.isAlive = false
+			return STATE_UPDATE, nil
 		}
 		newState = STATE_UPDATE
 	}
@@ -39,6 +59,10 @@ func (cmd UserCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState != STATE_AUTHORIZATION {
 		return 0, ErrInvalidState
 	}
+	if !c.plaintextAuthAllowed() {
+		c.printer.ErrCode("AUTH", "Plaintext authentication disallowed on non-secured connection")
+		return STATE_AUTHORIZATION, nil
+	}
 	if len(args) != 1 {
 		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
 	}
@@ -47,12 +71,23 @@ func (cmd UserCommand) Run(c *Client, args []string) (int, error) {
 	return STATE_AUTHORIZATION, nil
 }
 
+func (cmd UserCommand) Capabilities(c *Client) []string {
+	if !c.plaintextAuthAllowed() {
+		return nil
+	}
+	return []string{"USER"}
+}
+
 type PassCommand struct{}
 
 func (cmd PassCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState != STATE_AUTHORIZATION {
 		return 0, ErrInvalidState
 	}
+	if !c.plaintextAuthAllowed() {
+		c.printer.ErrCode("AUTH", "Plaintext authentication disallowed on non-secured connection")
+		return STATE_AUTHORIZATION, nil
+	}
 	if c.lastCommand != "USER" {
 		c.printer.Err("PASS can be executed only directly after USER command")
 		return STATE_AUTHORIZATION, nil
@@ -61,22 +96,239 @@ func (cmd PassCommand) Run(c *Client, args []string) (int, error) {
 		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
 	}
 	c.pass = args[0]
-	if !c.authorizator.Authorize(c.user, c.pass) {
-		c.printer.Err("Invalid username or password")
+	ok, err := c.authorize(c.user, c.pass)
+	if err != nil {
+		if code := responseCode(err); code != "" {
+			c.printer.ErrCode(code, "%v", err)
+			return STATE_AUTHORIZATION, nil
+		}
+		return 0, fmt.Errorf("Error authorizing user %s: %w", c.user, err)
+	}
+	if !ok {
+		c.printer.ErrCode("AUTH", "Invalid username or password")
 		return STATE_AUTHORIZATION, nil
 	}
 
-	err := c.backend.Lock(c.user)
+	return c.enterTransaction()
+}
+
+// enterTransaction locks maildrop of authorized user, after which the client
+// moves to TRANSACTION state
+func (c *Client) enterTransaction() (int, error) {
+	err := c.backend.Lock(c.ctx, c.user)
 	if err != nil {
-		c.printer.Err("Server was unable to lock maildrop")
-		return 0, fmt.Errorf("Error locking maildrop for user %s: %v", c.user, err)
+		c.printer.ErrCode(responseCode(err), "Server was unable to lock maildrop")
+		log.Printf("Error locking maildrop for user %s: %v", c.user, err)
+		return STATE_AUTHORIZATION, nil
 	}
 
+	err = c.snapshotMaildrop()
+	if err != nil {
+		c.backend.Unlock(c.ctx, c.user)
+		c.printer.ErrCode(responseCode(err), "Server was unable to read maildrop")
+		log.Printf("Error reading maildrop for user %s: %v", c.user, err)
+		return STATE_AUTHORIZATION, nil
+	}
+	c.deleted = make(map[int]bool)
 	c.printer.Ok("User Successfully Logged on")
 
 	return STATE_TRANSACTION, nil
 }
 
+// snapshotMaildrop reads sizes and unique IDs of all messages once after the maildrop
+// is locked, so message numbers don't change during the session even if new mail arrives
+func (c *Client) snapshotMaildrop() error {
+	sizes, err := c.backend.List(c.ctx, c.user)
+	if err != nil {
+		return fmt.Errorf("Error calling LIST for user %s: %w", c.user, err)
+	}
+	uids, err := c.backend.Uidl(c.ctx, c.user)
+	if err != nil {
+		return fmt.Errorf("Error calling UIDL for user %s: %w", c.user, err)
+	}
+	if len(uids) != len(sizes) {
+		return fmt.Errorf("Backend returned %d sizes, but %d unique IDs for user %s", len(sizes), len(uids), c.user)
+	}
+	c.maildrop = maildrop{sizes: sizes, uids: uids}
+	return nil
+}
+
+// messageExists returns whether message number refers to a message in the snapshot,
+// which is not marked as deleted
+func (c *Client) messageExists(msgNumber int) bool {
+	return msgNumber <= len(c.maildrop.sizes) && !c.deleted[msgNumber]
+}
+
+// update removes messages marked as deleted in the session from maildrop. Messages
+// are passed to ExpungeBackend at once if implemented, otherwise Dele is called for each
+// in descending order, so backends shifting message IDs after Dele delete the right ones.
+func (c *Client) update() error {
+	if len(c.deleted) > 0 {
+		msgIds := make([]int, 0, len(c.deleted))
+		for msgNumber := range c.deleted {
+			msgIds = append(msgIds, c.backendMsgId(msgNumber))
+		}
+		sort.Ints(msgIds)
+		if backend := expungeExtension(c.backend); backend != nil {
+			if err := backend.Expunge(c.ctx, c.user, msgIds); err != nil {
+				return err
+			}
+		} else {
+			for i := len(msgIds) - 1; i >= 0; i-- {
+				if err := c.backend.Dele(c.ctx, c.user, msgIds[i]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return c.backend.Update(c.ctx, c.user)
+}
+
+type ApopCommand struct{}
+
+func (cmd ApopCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	if len(args) != 2 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+	authorizator := secretExtension(c.authorizator)
+	if authorizator == nil || c.timestamp == "" {
+		c.printer.Err("APOP is not supported")
+		return STATE_AUTHORIZATION, nil
+	}
+
+	user, digest := args[0], strings.ToLower(args[1])
+	exists, secret, err := authorizator.Secret(c.ctx, user)
+	if err != nil {
+		return 0, fmt.Errorf("Error getting secret for user %s: %w", user, err)
+	}
+	sum := md5.Sum([]byte(c.timestamp + secret))
+	expected := hex.EncodeToString(sum[:])
+	if !exists || subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		c.printer.ErrCode("AUTH", "Invalid username or password")
+		return STATE_AUTHORIZATION, nil
+	}
+
+	c.user = user
+	return c.enterTransaction()
+}
+
+type AuthCommand struct{}
+
+func (cmd AuthCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	if len(args) == 0 {
+		// list of mechanisms according to RFC 1734
+		c.printer.Ok("")
+		c.printer.MultiLine(c.saslMechanismNames())
+		return STATE_AUTHORIZATION, nil
+	}
+	if len(args) > 2 {
+		return 0, fmt.Errorf("Invalid arguments count: %d", len(args))
+	}
+
+	name := strings.ToUpper(args[0])
+	mech, ok := c.saslMechanisms[name]
+	if !ok {
+		c.printer.Err("Unsupported authentication mechanism %s", name)
+		return STATE_AUTHORIZATION, nil
+	}
+	if mech.Plaintext() && !c.plaintextAuthAllowed() {
+		c.printer.ErrCode("AUTH", "Plaintext authentication disallowed on non-secured connection")
+		return STATE_AUTHORIZATION, nil
+	}
+
+	// initial response (RFC 4959), "=" stands for empty response
+	var response []byte
+	if len(args) == 2 {
+		response = []byte{}
+		if args[1] != "=" {
+			var err error
+			response, err = base64.StdEncoding.DecodeString(args[1])
+			if err != nil {
+				c.printer.Err("Invalid base64 data")
+				return STATE_AUTHORIZATION, nil
+			}
+		}
+	}
+
+	server := mech.Start(c)
+	for {
+		challenge, done, err := server.Next(response)
+		if err == ErrInvalidSaslResponse {
+			c.printer.Err("Invalid authentication data")
+			return STATE_AUTHORIZATION, nil
+		} else if code := responseCode(err); code != "" {
+			c.printer.ErrCode(code, "%v", err)
+			return STATE_AUTHORIZATION, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("Error authenticating using %s: %w", name, err)
+		}
+		if done {
+			break
+		}
+
+		c.printer.Continue(base64.StdEncoding.EncodeToString(challenge))
+		c.printer.Flush()
+		input, err := c.reader.ReadString('\n')
+		if err != nil {
+			// read interrupted by Server.Shutdown is answered by the session loop,
+			// nothing can be sent to broken connection
+			if !c.shuttingDown() {
+				log.Printf("Error reading authentication data: %v", err)
+				c.isAlive = false
+			}
+			return STATE_AUTHORIZATION, nil
+		}
+		input = strings.Trim(input, "\r\n")
+		if input == "*" {
+			c.printer.Err("Authentication cancelled")
+			return STATE_AUTHORIZATION, nil
+		}
+		response, err = base64.StdEncoding.DecodeString(input)
+		if err != nil {
+			c.printer.Err("Invalid base64 data")
+			return STATE_AUTHORIZATION, nil
+		}
+	}
+
+	c.user = server.User()
+	return c.enterTransaction()
+}
+
+func (cmd AuthCommand) Capabilities(c *Client) []string {
+	mechanisms := c.saslMechanismNames()
+	if len(mechanisms) == 0 {
+		return nil
+	}
+	return []string{"SASL " + strings.Join(mechanisms, " ")}
+}
+
+// parseMsgNumber parses message number given by client. Message numbers start at 1 (RFC 1939).
+func parseMsgNumber(arg string) (int, error) {
+	msgNumber, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, err
+	}
+	if msgNumber < 1 {
+		return 0, fmt.Errorf("message number %d out of range", msgNumber)
+	}
+	return msgNumber, nil
+}
+
+// backendMsgId translates message number given by client to message ID passed to Backend,
+// see Config.ZeroBasedMessageIds
+func (c *Client) backendMsgId(msgNumber int) int {
+	if c.zeroBasedMessageIds {
+		return msgNumber - 1
+	}
+	return msgNumber
+}
+
 type StatCommand struct{}
 
 func (cmd StatCommand) Run(c *Client, args []string) (int, error) {
@@ -84,9 +336,12 @@ func (cmd StatCommand) Run(c *Client, args []string) (int, error) {
 		return 0, ErrInvalidState
 	}
 
-	messages, octets, err := c.backend.Stat(c.user)
-	if err != nil {
-		return 0, fmt.Errorf("Error calling Stat for user %s: %v", c.user, err)
+	messages, octets := 0, 0
+	for i, size := range c.maildrop.sizes {
+		if !c.deleted[i+1] {
+			messages++
+			octets += size
+		}
 	}
 	c.printer.Ok("%d %d", messages, octets)
 	return STATE_TRANSACTION, nil
@@ -100,30 +355,24 @@ func (cmd ListCommand) Run(c *Client, args []string) (int, error) {
 	}
 
 	if len(args) > 0 {
-		msgId, err := strconv.Atoi(args[0])
+		msgNumber, err := parseMsgNumber(args[0])
 		if err != nil {
 			c.printer.Err("Invalid argument: %s", args[0])
-			return 0, fmt.Errorf("Invalid argument for LIST given by user %s: %v", c.user, err)
-		}
-		exists, octets, err := c.backend.ListMessage(c.user, msgId)
-		if err != nil {
-			return 0, fmt.Errorf("Error calling 'LIST %d' for user %s: %v", msgId, c.user, err)
+			return STATE_TRANSACTION, nil
 		}
-		if !exists {
+		if !c.messageExists(msgNumber) {
 			c.printer.Err("no such message")
 			return STATE_TRANSACTION, nil
 		}
-		c.printer.Ok("%d %d", msgId, octets)
+		c.printer.Ok("%d %d", msgNumber, c.maildrop.sizes[msgNumber-1])
 	} else {
-		octets, err := c.backend.List(c.user)
-		if err != nil {
-			return 0, fmt.Errorf("Error calling LIST for user %s: %v", c.user, err)
-		}
-		c.printer.Ok("%d messages", len(octets))
-		messagesList := make([]string, len(octets))
-		for i, octet := range octets {
-			messagesList[i] = fmt.Sprintf("%d %d", i, octet)
+		var messagesList []string
+		for i, octet := range c.maildrop.sizes {
+			if !c.deleted[i+1] {
+				messagesList = append(messagesList, fmt.Sprintf("%d %d", i+1, octet))
+			}
 		}
+		c.printer.Ok("%d messages", len(messagesList))
 		c.printer.MultiLine(messagesList)
 	}
 
@@ -138,25 +387,130 @@ func (cmd RetrCommand) Run(c *Client, args []string) (int, error) {
 	}
 	if len(args) == 0 {
 		c.printer.Err("Missing argument for RETR command")
-		return 0, fmt.Errorf("Missing argument for RETR called by user %s", c.user)
+		return STATE_TRANSACTION, nil
 	}
 
-	msgId, err := strconv.Atoi(args[0])
+	msgNumber, err := parseMsgNumber(args[0])
 	if err != nil {
 		c.printer.Err("Invalid argument: %s", args[0])
-		return 0, fmt.Errorf("Invalid argument for RETR given by user %s: %v", c.user, err)
+		return STATE_TRANSACTION, nil
 	}
+	if c.deleted[msgNumber] {
+		c.printer.Err("message already deleted")
+		return STATE_TRANSACTION, nil
+	}
+	if !c.messageExists(msgNumber) {
+		c.printer.Err("no such message")
+		return STATE_TRANSACTION, nil
+	}
+	msgId := c.backendMsgId(msgNumber)
 
-	message, err := c.backend.Retr(c.user, msgId)
+	message, err := c.retrReader(msgId)
 	if err != nil {
-		return 0, fmt.Errorf("Error calling 'RETR %d' for user %s: %v", msgId, c.user, err)
+		return 0, fmt.Errorf("Error calling 'RETR %d' for user %s: %w", msgId, c.user, err)
+	}
+	defer message.Close()
+	c.printer.Ok("")
+	err = c.printer.MultiLineReader(message)
+	if err != nil {
+		// response can't be completed, so the connection is closed
+		log.Printf("Error reading message %d of user %s: %v", msgId, c.user, err)
+		c.isAlive = false
+	}
+	return STATE_TRANSACTION, nil
+}
+
+// retrReader returns message reader from ReaderBackend or wraps message returned by Retr
+func (c *Client) retrReader(msgId int) (io.ReadCloser, error) {
+	if backend := readerExtension(c.backend); backend != nil {
+		return backend.RetrReader(c.ctx, c.user, msgId)
+	}
+	message, err := c.backend.Retr(c.ctx, c.user, msgId)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(message)), nil
+}
+
+type TopCommand struct{}
+
+func (cmd TopCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_TRANSACTION {
+		return 0, ErrInvalidState
+	}
+	if len(args) != 2 {
+		c.printer.Err("Invalid arguments count for TOP command")
+		return STATE_TRANSACTION, nil
+	}
+
+	msgNumber, err := parseMsgNumber(args[0])
+	if err != nil {
+		c.printer.Err("Invalid argument: %s", args[0])
+		return STATE_TRANSACTION, nil
+	}
+	if c.deleted[msgNumber] {
+		c.printer.Err("message already deleted")
+		return STATE_TRANSACTION, nil
+	}
+	if !c.messageExists(msgNumber) {
+		c.printer.Err("no such message")
+		return STATE_TRANSACTION, nil
+	}
+	msgId := c.backendMsgId(msgNumber)
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 {
+		c.printer.Err("Invalid argument: %s", args[1])
+		return STATE_TRANSACTION, nil
+	}
+
+	var lines []string
+	if backend := topExtension(c.backend); backend != nil {
+		message, err := backend.Top(c.ctx, c.user, msgId, n)
+		if err != nil {
+			return 0, fmt.Errorf("Error calling 'TOP %d %d' for user %s: %w", msgId, n, c.user, err)
+		}
+		lines = messageLines(message)
+	} else {
+		message, err := c.backend.Retr(c.ctx, c.user, msgId)
+		if err != nil {
+			return 0, fmt.Errorf("Error calling 'RETR %d' for user %s: %w", msgId, c.user, err)
+		}
+		lines = topLines(messageLines(message), n)
 	}
-	lines := strings.Split(message, "\n")
 	c.printer.Ok("")
 	c.printer.MultiLine(lines)
 	return STATE_TRANSACTION, nil
 }
 
+func (cmd TopCommand) Capabilities(c *Client) []string {
+	return []string{"TOP"}
+}
+
+// messageLines splits message into lines, line ending of the last line
+// doesn't start another line, as it doesn't for RETR
+func messageLines(message string) []string {
+	lines := strings.Split(message, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// topLines returns header lines of the message, blank separator line and first n lines of the body
+func topLines(lines []string, n int) []string {
+	for i, line := range lines {
+		if strings.TrimRight(line, "\r") == "" {
+			end := i + 1 + n
+			if end > len(lines) {
+				end = len(lines)
+			}
+			return lines[:end]
+		}
+	}
+	// message without body
+	return lines
+}
+
 type DeleCommand struct{}
 
 func (cmd DeleCommand) Run(c *Client, args []string) (int, error) {
@@ -165,20 +519,26 @@ func (cmd DeleCommand) Run(c *Client, args []string) (int, error) {
 	}
 	if len(args) == 0 {
 		c.printer.Err("Missing argument for DELE command")
-		return 0, fmt.Errorf("Missing argument for DELE called by user %s", c.user)
+		return STATE_TRANSACTION, nil
 	}
 
-	msgId, err := strconv.Atoi(args[0])
+	msgNumber, err := parseMsgNumber(args[0])
 	if err != nil {
 		c.printer.Err("Invalid argument: %s", args[0])
-		return 0, fmt.Errorf("Invalid argument for DELE given by user %s: %v", c.user, err)
+		return STATE_TRANSACTION, nil
 	}
-	err = c.backend.Dele(c.user, msgId)
-	if err != nil {
-		return 0, fmt.Errorf("Error calling 'DELE %d' for user %s: %v", msgId, c.user, err)
+	if c.deleted[msgNumber] {
+		c.printer.Err("message already deleted")
+		return STATE_TRANSACTION, nil
+	}
+	if !c.messageExists(msgNumber) {
+		c.printer.Err("no such message")
+		return STATE_TRANSACTION, nil
 	}
 
-	c.printer.Ok("Message %d deleted", msgId)
+	// message is removed from maildrop in UPDATE state, see Client.update
+	c.deleted[msgNumber] = true
+	c.printer.Ok("Message %d deleted", msgNumber)
 
 	return STATE_TRANSACTION, nil
 }
@@ -199,11 +559,7 @@ func (cmd RsetCommand) Run(c *Client, args []string) (int, error) {
 	if c.currentState != STATE_TRANSACTION {
 		return 0, ErrInvalidState
 	}
-	err := c.backend.Rset(c.user)
-	if err != nil {
-		return 0, fmt.Errorf("Error calling 'RSET' for user %s: %v", c.user, err)
-	}
-
+	c.deleted = make(map[int]bool)
 	c.printer.Ok("")
 
 	return STATE_TRANSACTION, nil
@@ -217,44 +573,139 @@ func (cmd UidlCommand) Run(c *Client, args []string) (int, error) {
 	}
 
 	if len(args) > 0 {
-		msgId, err := strconv.Atoi(args[0])
+		msgNumber, err := parseMsgNumber(args[0])
 		if err != nil {
 			c.printer.Err("Invalid argument: %s", args[0])
-			return 0, fmt.Errorf("Invalid argument for UIDL given by user %s: %v", c.user, err)
-		}
-		exists, uid, err := c.backend.UidlMessage(c.user, msgId)
-		if err != nil {
-			return 0, fmt.Errorf("Error calling 'UIDL %d' for user %s: %v", msgId, c.user, err)
+			return STATE_TRANSACTION, nil
 		}
-		if !exists {
+		if !c.messageExists(msgNumber) {
 			c.printer.Err("no such message")
 			return STATE_TRANSACTION, nil
 		}
-		c.printer.Ok("%d %s", msgId, uid)
+		c.printer.Ok("%d %s", msgNumber, c.maildrop.uids[msgNumber-1])
 	} else {
-		uids, err := c.backend.Uidl(c.user)
-		if err != nil {
-			return 0, fmt.Errorf("Error calling UIDL for user %s: %v", c.user, err)
-		}
-		c.printer.Ok("%d messages", len(uids))
-		uidsList := make([]string, len(uids))
-		for i, uid := range uids {
-			uidsList[i] = fmt.Sprintf("%d %s", i, uid)
+		var uidsList []string
+		for i, uid := range c.maildrop.uids {
+			if !c.deleted[i+1] {
+				uidsList = append(uidsList, fmt.Sprintf("%d %s", i+1, uid))
+			}
 		}
+		c.printer.Ok("%d messages", len(uidsList))
 		c.printer.MultiLine(uidsList)
 	}
 
 	return STATE_TRANSACTION, nil
 }
 
+func (cmd UidlCommand) Capabilities(c *Client) []string {
+	return []string{"UIDL"}
+}
+
 type CapaCommand struct{}
 
 func (cmd CapaCommand) Run(c *Client, args []string) (int, error) {
-	c.printer.Ok("")
-	var commands []string
-	commands = []string{"USER", "UIDL"}
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var capabilities []string
+	for _, name := range names {
+		if cmd, ok := c.commands[name].(Capable); ok {
+			capabilities = append(capabilities, cmd.Capabilities(c)...)
+		}
+	}
 
-	c.printer.MultiLine(commands)
+	c.printer.Ok("")
+	c.printer.MultiLine(capabilities)
 
 	return c.currentState, nil
 }
+
+// Capabilities returns capabilities which are not related to any particular command
+func (cmd CapaCommand) Capabilities(c *Client) []string {
+	capabilities := []string{"RESP-CODES", "AUTH-RESP-CODE", "PIPELINING"}
+
+	expire, loginDelay := c.expire, c.loginDelay
+	suffix := ""
+	if backend := userPolicyExtension(c.backend); backend != nil {
+		if c.currentState == STATE_TRANSACTION {
+			if policy, err := backend.Expire(c.ctx, c.user); err != nil {
+				log.Printf("Error getting EXPIRE policy for user %s: %v", c.user, err)
+			} else if policy != "" {
+				expire = policy
+			}
+			if seconds, err := backend.LoginDelay(c.ctx, c.user); err != nil {
+				log.Printf("Error getting LOGIN-DELAY policy for user %s: %v", c.user, err)
+			} else if seconds != 0 {
+				loginDelay = seconds
+			}
+		} else {
+			// policy varies per user
+			suffix = " USER"
+		}
+	}
+	if expire != "" {
+		capabilities = append(capabilities, "EXPIRE "+expire+suffix)
+	}
+	if loginDelay > 0 {
+		capabilities = append(capabilities, fmt.Sprintf("LOGIN-DELAY %d%s", loginDelay, suffix))
+	}
+
+	return append(capabilities, "IMPLEMENTATION POPgun")
+}
+
+type StlsCommand struct{}
+
+func (cmd StlsCommand) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	if c.tlsActive {
+		c.printer.Err("Command not permitted when TLS active")
+		return STATE_AUTHORIZATION, nil
+	}
+	if c.tlsConfig == nil {
+		c.printer.Err("STLS is not supported")
+		return STATE_AUTHORIZATION, nil
+	}
+
+	c.printer.Ok("Begin TLS negotiation")
+	err := c.startTLS()
+	if err != nil {
+		// +OK was already sent, so the connection is closed without another response
+		log.Printf("TLS negotiation failed: %v", err)
+		c.isAlive = false
+		return STATE_AUTHORIZATION, nil
+	}
+	// client must discard all knowledge obtained before TLS negotiation,
+	// and so does the server
+	c.user = ""
+	c.pass = ""
+
+	return STATE_AUTHORIZATION, nil
+}
+
+func (cmd StlsCommand) Capabilities(c *Client) []string {
+	if c.tlsConfig == nil || c.tlsActive || c.currentState != STATE_AUTHORIZATION {
+		return nil
+	}
+	return []string{"STLS"}
+}
+
+type Utf8Command struct{}
+
+func (cmd Utf8Command) Run(c *Client, args []string) (int, error) {
+	if c.currentState != STATE_AUTHORIZATION {
+		return 0, ErrInvalidState
+	}
+	c.printer.Ok("UTF8 enabled")
+	return STATE_AUTHORIZATION, nil
+}
+
+// Capabilities announces UTF8 command (RFC 6856), USER argument means that
+// UTF-8 user names and passwords are accepted by USER and PASS commands
+func (cmd Utf8Command) Capabilities(c *Client) []string {
+	return []string{"UTF8 USER"}
+}
@@ -1,14 +1,97 @@
 package popgun
 
 import (
+	"crypto/tls"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/DevelHell/popgun/backends"
 )
 
+// secretAuthorizator is an authorizator with shared secrets used to test APOP
+type secretAuthorizator map[string]string
+
+func (a secretAuthorizator) Authorize(user, pass string) bool {
+	secret, ok := a[user]
+	return ok && secret == pass
+}
+
+func (a secretAuthorizator) Secret(user string) (exists bool, secret string, err error) {
+	secret, exists = a[user]
+	return exists, secret, nil
+}
+
+// errorAuthorizator implements optional ErrorAuthorizator interface
+type errorAuthorizator struct {
+	backends.DummyAuthorizator
+	err error
+}
+
+func (a errorAuthorizator) AuthorizeErr(user, pass string) (bool, error) {
+	return false, a.err
+}
+
+// lockedBackend fails to lock maildrop
+type lockedBackend struct {
+	backends.DummyBackend
+	err error
+}
+
+func (b lockedBackend) Lock(user string) error {
+	return b.err
+}
+
+// deleteMessages marks messages as deleted in the session
+func deleteMessages(msgNumbers ...int) func(c *Client) {
+	return func(c *Client) {
+		for _, msgNumber := range msgNumbers {
+			c.deleted[msgNumber] = true
+		}
+	}
+}
+
+// growingBackend receives new message whenever List is called
+type growingBackend struct {
+	backends.DummyBackend
+	messages *int
+	err      error
+}
+
+func (b growingBackend) List(user string) ([]int, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	*b.messages++
+	return make([]int, *b.messages), nil
+}
+
+func (b growingBackend) Uidl(user string) ([]string, error) {
+	return make([]string, *b.messages), nil
+}
+
+func TestClient_snapshotMaildrop(t *testing.T) {
+	messages := 2
+	backend := growingBackend{messages: &messages}
+	sessionTest(t, newClient(backends.DummyAuthorizator{}, backend), []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"STAT", "^\\+OK 3 0\r\n$"},
+		{"LIST 4", "^-ERR no such message\r\n$"},
+		{"DELE 3", "^\\+OK"},
+		{"STAT", "^\\+OK 2 0\r\n$"},
+	})
+	if messages != 3 {
+		t.Errorf("Expected List to be called once, but maildrop has %d messages", messages)
+	}
+}
+
 type cmdTestCase struct {
 	cmd            Executable
 	initialState   int
@@ -16,6 +99,7 @@ type cmdTestCase struct {
 	expectedState  int
 	expectedErr    bool
 	expectedOutput string
+	setup          func(c *Client)
 }
 
 func commandTest(t *testing.T, tc cmdTestCase) {
@@ -27,9 +111,18 @@ func commandTest(t *testing.T, tc cmdTestCase) {
 		authorizator := backends.DummyAuthorizator{}
 		client := newClient(authorizator, backend)
 		client.currentState = tc.initialState
+		if tc.setup != nil {
+			tc.setup(client)
+		}
+		if tc.initialState == STATE_TRANSACTION {
+			if err := client.snapshotMaildrop(); err != nil {
+				t.Error(err)
+			}
+		}
 
 		client.printer = NewPrinter(s)
 		state, err := tc.cmd.Run(client, tc.args)
+		client.printer.Flush()
 		if state != tc.expectedState {
 			t.Errorf("Expected state '%d', but got '%d'", tc.expectedState, state)
 		}
@@ -55,6 +148,95 @@ func commandTest(t *testing.T, tc cmdTestCase) {
 	}
 }
 
+// deletingBackend records messages deleted by Dele or Expunge
+type deletingBackend struct {
+	backends.DummyBackend
+	deleted *[]int
+}
+
+func (b deletingBackend) Dele(user string, msgId int) error {
+	*b.deleted = append(*b.deleted, msgId)
+	return nil
+}
+
+type expungingBackend struct {
+	deletingBackend
+	expunged *[]int
+}
+
+func (b expungingBackend) Expunge(user string, msgIds []int) error {
+	*b.expunged = append(*b.expunged, msgIds...)
+	return nil
+}
+
+func TestQuitCommand_RunUpdate(t *testing.T) {
+	deleted, expunged := []int{}, []int{}
+	testCases := []struct {
+		backend  Backend
+		result   *[]int
+		expected []int
+	}{
+		// descending order keeps IDs of backends shifting them after Dele valid
+		{deletingBackend{deleted: &deleted}, &deleted, []int{4, 2}},
+		{expungingBackend{deletingBackend{deleted: &deleted}, &expunged}, &expunged, []int{2, 4}},
+	}
+	for _, testCase := range testCases {
+		deleted, expunged = []int{}, []int{}
+		commandTest(t, cmdTestCase{
+			cmd:            QuitCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_UPDATE,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK Goodbye",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(testCase.backend)
+				c.deleted = map[int]bool{4: true, 2: true}
+			},
+		})
+		if !reflect.DeepEqual(*testCase.result, testCase.expected) {
+			t.Errorf("Expected messages %v to be deleted, but got %v", testCase.expected, *testCase.result)
+		}
+		if testCase.result == &expunged && len(deleted) > 0 {
+			t.Errorf("Expected Dele not to be called, but got %v", deleted)
+		}
+	}
+}
+
+// updateFailingBackend fails to delete messages
+type updateFailingBackend struct {
+	backends.DummyBackend
+	deleCalls *int
+	unlocked  *bool
+}
+
+func (b updateFailingBackend) Dele(user string, msgId int) error {
+	*b.deleCalls++
+	return ErrTemporary
+}
+
+func (b updateFailingBackend) Unlock(user string) error {
+	*b.unlocked = true
+	return nil
+}
+
+func TestQuitCommand_RunUpdateFailure(t *testing.T) {
+	deleCalls, unlocked := 0, false
+	backend := updateFailingBackend{deleCalls: &deleCalls, unlocked: &unlocked}
+	sessionTest(t, newClient(backends.DummyAuthorizator{}, backend), []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"DELE 1", "^\\+OK"},
+		{"QUIT", "^-ERR \\[SYS/TEMP\\] Some deleted messages not removed\r\n$"},
+	})
+	if deleCalls != 1 {
+		t.Errorf("Expected Dele to be called once, but got %d calls", deleCalls)
+	}
+	if !unlocked {
+		t.Error("Expected maildrop to be unlocked when session ends")
+	}
+}
+
 func TestQuitCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -106,6 +288,29 @@ func TestUserCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "^\\+OK",
 		},
+		{
+			cmd:            UserCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"john"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Plaintext authentication disallowed",
+			setup: func(c *Client) {
+				c.disablePlaintextAuth = true
+			},
+		},
+		{
+			cmd:            UserCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"john"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK",
+			setup: func(c *Client) {
+				c.disablePlaintextAuth = true
+				c.tlsActive = true
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -131,6 +336,108 @@ func TestPassCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "",
 		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Plaintext authentication disallowed",
+			setup: func(c *Client) {
+				c.disablePlaintextAuth = true
+				c.lastCommand = "USER"
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK User Successfully Logged on",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[IN-USE\\] Server was unable to lock maildrop\r\n$",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.backend = AdaptBackend(lockedBackend{err: fmt.Errorf("maildrop of john: %w", ErrMailboxInUse)})
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Server was unable to lock maildrop\r\n$",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.backend = AdaptBackend(lockedBackend{err: fmt.Errorf("disk full")})
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[SYS/TEMP\\] Server was unable to read maildrop\r\n$",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.backend = AdaptBackend(growingBackend{err: ErrTemporary})
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[LOGIN-DELAY\\] Minimum time between logins has not elapsed\r\n$",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.authorizator = AdaptAuthorizator(errorAuthorizator{err: ErrLoginDelay})
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"secret"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.authorizator = AdaptAuthorizator(errorAuthorizator{err: fmt.Errorf("database is down")})
+			},
+		},
+		{
+			cmd:            PassCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"wrong"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Invalid username or password\r\n$",
+			setup: func(c *Client) {
+				c.user = "john"
+				c.lastCommand = "USER"
+				c.authorizator = AdaptAuthorizator(secretAuthorizator{"john": "secret"})
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -156,6 +463,15 @@ func TestStatCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "^\\+OK 5 50",
 		},
+		{
+			cmd:            StatCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK 3 30\r\n$",
+			setup:          deleteMessages(1, 3),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -177,8 +493,8 @@ func TestListCommand_Run(t *testing.T) {
 			cmd:            ListCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{"a"},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Invalid argument: a",
 		},
 		{
@@ -197,13 +513,39 @@ func TestListCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "^\\-ERR no such message",
 		},
+		{
+			cmd:            ListCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Invalid argument: 0",
+		},
+		{
+			cmd:            ListCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK 5 messages\r\n1 10\r\n2 10\r\n3 10\r\n4 10\r\n5 10\r\n\\.",
+		},
 		{
 			cmd:            ListCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{},
 			expectedState:  STATE_TRANSACTION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK 5 messages\r\n0 10\r\n1 10\r\n2 10\r\n3 10\r\n4 10\r\n\\.",
+			expectedOutput: "^\\+OK 4 messages\r\n1 10\r\n3 10\r\n4 10\r\n5 10\r\n\\.\r\n$",
+			setup:          deleteMessages(2),
+		},
+		{
+			cmd:            ListCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"2"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR no such message",
+			setup:          deleteMessages(2),
 		},
 	}
 
@@ -212,6 +554,48 @@ func TestListCommand_Run(t *testing.T) {
 	}
 }
 
+// readerBackend streams messages from RetrReader, failing reader is returned for message 5
+type readerBackend struct {
+	backends.DummyBackend
+	closed *bool
+}
+
+func (b readerBackend) RetrReader(user string, msgId int) (io.ReadCloser, error) {
+	var r io.Reader = strings.NewReader(fmt.Sprintf("streamed\n.message %d\n", msgId))
+	if msgId == 5 {
+		r = io.MultiReader(strings.NewReader("partial\n"), iotest.ErrReader(fmt.Errorf("disk error")))
+	}
+	return readCloser{r, b.closed}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closed *bool
+}
+
+func (r readCloser) Close() error {
+	*r.closed = true
+	return nil
+}
+
+func TestRetrCommand_RunReader(t *testing.T) {
+	closed := false
+	backend := readerBackend{closed: &closed}
+	sessionTest(t, newClient(backends.DummyAuthorizator{}, backend), []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"RETR 2", "^\\+OK"},
+		{"", "^streamed\r\n$"},
+		{"", "^\\.\\.message 2\r\n$"},
+		{"", "^\\.\r\n$"},
+		{"RETR 5", "^\\+OK"},
+		{"", "^partial\r\n$"},
+	})
+	if !closed {
+		t.Error("Expected message reader to be closed")
+	}
+}
+
 func TestRetrCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -226,16 +610,16 @@ func TestRetrCommand_Run(t *testing.T) {
 			cmd:            RetrCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Missing argument for RETR command",
 		},
 		{
 			cmd:            RetrCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{"a"},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Invalid argument: a",
 		},
 		{
@@ -246,6 +630,15 @@ func TestRetrCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "^\\+OK \r\nthis is dummy message\r\n\\.",
 		},
+		{
+			cmd:            RetrCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR message already deleted\r\n$",
+			setup:          deleteMessages(1),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -267,16 +660,16 @@ func TestDeleCommand_Run(t *testing.T) {
 			cmd:            DeleCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Missing argument for DELE command",
 		},
 		{
 			cmd:            DeleCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{"foo"},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Invalid argument: foo",
 		},
 		{
@@ -287,6 +680,23 @@ func TestDeleCommand_Run(t *testing.T) {
 			expectedErr:    false,
 			expectedOutput: "^\\+OK Message 1 deleted",
 		},
+		{
+			cmd:            DeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"6"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR no such message",
+		},
+		{
+			cmd:            DeleCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR message already deleted",
+			setup:          deleteMessages(1),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -344,6 +754,19 @@ func TestRsetCommand_Run(t *testing.T) {
 	}
 }
 
+func TestRsetCommand_RunSession(t *testing.T) {
+	sessionTest(t, newClient(backends.DummyAuthorizator{}, backends.DummyBackend{}), []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"DELE 2", "^\\+OK Message 2 deleted\r\n$"},
+		{"STAT", "^\\+OK 4 40\r\n$"},
+		{"RETR 2", "^-ERR message already deleted\r\n$"},
+		{"RSET", "^\\+OK"},
+		{"STAT", "^\\+OK 5 50\r\n$"},
+		{"LIST 2", "^\\+OK 2 10\r\n$"},
+	})
+}
+
 func TestUidlCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -358,8 +781,8 @@ func TestUidlCommand_Run(t *testing.T) {
 			cmd:            UidlCommand{},
 			initialState:   STATE_TRANSACTION,
 			args:           []string{"a"},
-			expectedState:  0,
-			expectedErr:    true,
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
 			expectedOutput: "^\\-ERR Invalid argument: a",
 		},
 		{
@@ -376,7 +799,15 @@ func TestUidlCommand_Run(t *testing.T) {
 			args:           []string{"1"},
 			expectedState:  STATE_TRANSACTION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK 1 2",
+			expectedOutput: "^\\+OK 1 1\r\n$",
+		},
+		{
+			cmd:            UidlCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK 5 messages\r\n1 1\r\n2 2\r\n3 3\r\n4 4\r\n5 5\r\n\\.",
 		},
 		{
 			cmd:            UidlCommand{},
@@ -384,7 +815,8 @@ func TestUidlCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_TRANSACTION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK 5 messages\r\n0 1\r\n1 2\r\n2 3\r\n3 4\r\n4 5\r\n\\.",
+			expectedOutput: "^\\+OK 3 messages\r\n2 2\r\n3 3\r\n4 4\r\n\\.\r\n$",
+			setup:          deleteMessages(1, 5),
 		},
 	}
 
@@ -393,6 +825,28 @@ func TestUidlCommand_Run(t *testing.T) {
 	}
 }
 
+// userPolicyBackend implements optional UserPolicyBackend interface
+type userPolicyBackend struct {
+	backends.DummyBackend
+}
+
+func (b userPolicyBackend) Expire(user string) (string, error) {
+	return "NEVER", nil
+}
+
+func (b userPolicyBackend) LoginDelay(user string) (int, error) {
+	return 0, nil
+}
+
+// capabilityCommand is a custom command contributing capability
+type capabilityCommand struct {
+	NoopCommand
+}
+
+func (cmd capabilityCommand) Capabilities(c *Client) []string {
+	return []string{"X-CUSTOM"}
+}
+
 func TestCapaCommand_Run(t *testing.T) {
 	testCases := []cmdTestCase{
 		{
@@ -401,7 +855,99 @@ func TestCapaCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_TRANSACTION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\n\\.",
+			expectedOutput: "^\\+OK \r\nSASL LOGIN PLAIN\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nIMPLEMENTATION POPgun\r\nTOP\r\nUIDL\r\nUSER\r\n\\.\r\n$",
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSASL LOGIN PLAIN\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nIMPLEMENTATION POPgun\r\nTOP\r\nUIDL\r\nUSER\r\n\\.\r\n$",
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "\r\nIMPLEMENTATION POPgun\r\nSTLS\r\nTOP\r\n",
+			setup: func(c *Client) {
+				c.tlsConfig = &tls.Config{}
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "\r\nIMPLEMENTATION POPgun\r\nTOP\r\n",
+			setup: func(c *Client) {
+				c.tlsConfig = &tls.Config{}
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "\r\nIMPLEMENTATION POPgun\r\nTOP\r\n",
+			setup: func(c *Client) {
+				c.tlsConfig = &tls.Config{}
+				c.tlsActive = true
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nIMPLEMENTATION POPgun\r\nSTLS\r\nTOP\r\nUIDL\r\n\\.\r\n$",
+			setup: func(c *Client) {
+				c.tlsConfig = &tls.Config{}
+				c.disablePlaintextAuth = true
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nEXPIRE 30\r\nLOGIN-DELAY 900\r\nIMPLEMENTATION POPgun\r\n",
+			setup: func(c *Client) {
+				c.expire = "30"
+				c.loginDelay = 900
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nEXPIRE 30 USER\r\nLOGIN-DELAY 900 USER\r\nIMPLEMENTATION POPgun\r\n",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(userPolicyBackend{})
+				c.expire = "30"
+				c.loginDelay = 900
+			},
+		},
+		{
+			cmd:            CapaCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nEXPIRE NEVER\r\nLOGIN-DELAY 900\r\nIMPLEMENTATION POPgun\r\n",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(userPolicyBackend{})
+				c.expire = "30"
+				c.loginDelay = 900
+			},
 		},
 		{
 			cmd:            CapaCommand{},
@@ -409,7 +955,388 @@ func TestCapaCommand_Run(t *testing.T) {
 			args:           []string{},
 			expectedState:  STATE_AUTHORIZATION,
 			expectedErr:    false,
-			expectedOutput: "^\\+OK \r\nUSER\r\nUIDL\r\n\\.",
+			expectedOutput: "\r\nUSER\r\nUTF8 USER\r\nX-CUSTOM\r\n\\.\r\n$",
+			setup: func(c *Client) {
+				c.commands["UTF8"] = Utf8Command{}
+				c.commands["XCUSTOM"] = capabilityCommand{}
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+func TestStlsCommand_Run(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            StlsCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+		},
+		{
+			cmd:            StlsCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR STLS is not supported",
+		},
+		{
+			cmd:            StlsCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Command not permitted when TLS active",
+			setup: func(c *Client) {
+				c.tlsConfig = &tls.Config{}
+				c.tlsActive = true
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+func TestApopCommand_Run(t *testing.T) {
+	// example from RFC 1939 section 7
+	apopSetup := func(c *Client) {
+		c.authorizator = AdaptAuthorizator(secretAuthorizator{"mrose": "tanstaaf"})
+		c.timestamp = "<1896.697170952@dbc.mtview.ca.us>"
+	}
+	testCases := []cmdTestCase{
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+			setup:          apopSetup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+			setup:          apopSetup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR APOP is not supported",
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK User Successfully Logged on",
+			setup:          apopSetup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "C4C9334BAC560ECC979E58001B3E22FB"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK User Successfully Logged on",
+			setup:          apopSetup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"mrose", "00000000000000000000000000000000"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Invalid username or password",
+			setup:          apopSetup,
+		},
+		{
+			cmd:            ApopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"john", "c4c9334bac560ecc979e58001b3e22fb"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Invalid username or password",
+			setup:          apopSetup,
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+func TestAuthCommand_Run(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"PLAIN"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nLOGIN\r\nPLAIN\r\n\\.",
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"UNKNOWN"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Unsupported authentication mechanism UNKNOWN",
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"plain", "AGpvaG4Ac2VjcmV0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK User Successfully Logged on",
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"PLAIN", "AGpvaG4Ad3Jvbmc="},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Authentication failed",
+			setup: func(c *Client) {
+				c.authorizator = AdaptAuthorizator(secretAuthorizator{"john": "secret"})
+			},
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"PLAIN", "=="},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Invalid base64 data",
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"PLAIN", "AGpvaG4Ac2VjcmV0"},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR \\[AUTH\\] Plaintext authentication disallowed",
+			setup: func(c *Client) {
+				c.disablePlaintextAuth = true
+			},
+		},
+		{
+			cmd:            AuthCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\n\\.",
+			setup: func(c *Client) {
+				c.disablePlaintextAuth = true
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+// topBackend implements optional TopBackend interface
+type topBackend struct {
+	backends.DummyBackend
+}
+
+func (b topBackend) Top(user string, msgId, n int) (string, error) {
+	return fmt.Sprintf("Subject: top %d %d\r\n\r\nfirst line", msgId, n), nil
+}
+
+// messageBackend returns the same message for all message IDs
+type messageBackend struct {
+	backends.DummyBackend
+	message string
+}
+
+func (b messageBackend) Retr(user string, msgId int) (string, error) {
+	return b.message, nil
+}
+
+// messageTopBackend returns the whole message by Top
+type messageTopBackend struct {
+	messageBackend
+}
+
+func (b messageTopBackend) Top(user string, msgId, n int) (string, error) {
+	return b.message, nil
+}
+
+func TestTopCommand_Run(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{"1", "0"},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Invalid arguments count for TOP command",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"a", "0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Invalid argument: a",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "-1"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\-ERR Invalid argument: -1",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nthis is dummy message\r\n\\.\r\n$",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"2", "3"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSubject: top 2 3\r\n\r\nfirst line\r\n\\.\r\n$",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(topBackend{})
+			},
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"2", "3"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSubject: top 1 3\r\n",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(topBackend{})
+				c.zeroBasedMessageIds = true
+			},
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"6", "0"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^-ERR no such message\r\n$",
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "10"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSubject: a\r\n\r\nbody\r\n\\.\r\n$",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(messageBackend{message: "Subject: a\n\nbody\n"})
+			},
+		},
+		{
+			cmd:            TopCommand{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{"1", "10"},
+			expectedState:  STATE_TRANSACTION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK \r\nSubject: a\r\n\r\nbody\r\n\\.\r\n$",
+			setup: func(c *Client) {
+				c.backend = AdaptBackend(messageTopBackend{messageBackend{message: "Subject: a\r\n\r\nbody\r\n"}})
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		commandTest(t, testCase)
+	}
+}
+
+func TestTopLines(t *testing.T) {
+	message := strings.Split("From: john\r\nSubject: test\r\n\r\nline 1\r\nline 2\r\n.line 3", "\n")
+	testCases := []struct {
+		n        int
+		expected []string
+	}{
+		{0, []string{"From: john\r", "Subject: test\r", "\r"}},
+		{2, []string{"From: john\r", "Subject: test\r", "\r", "line 1\r", "line 2\r"}},
+		{10, message},
+	}
+	for _, testCase := range testCases {
+		lines := topLines(message, testCase.n)
+		if !reflect.DeepEqual(lines, testCase.expected) {
+			t.Errorf("Expected %q, but got %q", testCase.expected, lines)
+		}
+	}
+
+	if lines := topLines(messageLines("Subject: a\n\nbody\n"), 10); !reflect.DeepEqual(lines, []string{"Subject: a", "", "body"}) {
+		t.Errorf("Expected trailing line ending not to start a line, but got %q", lines)
+	}
+
+	headersOnly := []string{"From: john", "Subject: test"}
+	if lines := topLines(headersOnly, 1); !reflect.DeepEqual(lines, headersOnly) {
+		t.Errorf("Expected %q, but got %q", headersOnly, lines)
+	}
+}
+
+func TestUtf8Command_Run(t *testing.T) {
+	testCases := []cmdTestCase{
+		{
+			cmd:            Utf8Command{},
+			initialState:   STATE_TRANSACTION,
+			args:           []string{},
+			expectedState:  0,
+			expectedErr:    true,
+			expectedOutput: "",
+		},
+		{
+			cmd:            Utf8Command{},
+			initialState:   STATE_AUTHORIZATION,
+			args:           []string{},
+			expectedState:  STATE_AUTHORIZATION,
+			expectedErr:    false,
+			expectedOutput: "^\\+OK UTF8 enabled",
 		},
 	}
 
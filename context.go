@@ -0,0 +1,306 @@
+package popgun
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+)
+
+// AuthorizatorV2 is a context-aware variant of Authorizator. The context is cancelled
+// when the client disconnects and carries SessionInfo of the client. Optional interfaces
+// like SecretAuthorizator are detected on AuthorizatorV2 implementation as well, their
+// context-aware variants (e.g. SecretAuthorizatorV2) take precedence.
+type AuthorizatorV2 interface {
+	Authorize(ctx context.Context, user, pass string) (ok bool, err error)
+}
+
+// BackendV2 is a context-aware variant of Backend, see Backend for details of the methods.
+// The context is cancelled when the client disconnects and carries SessionInfo of the client.
+// Optional interfaces like TopBackend are detected on BackendV2 implementation as well,
+// their context-aware variants (e.g. TopBackendV2) take precedence.
+type BackendV2 interface {
+	List(ctx context.Context, user string) (octets []int, err error)
+	Retr(ctx context.Context, user string, msgId int) (message string, err error)
+	Dele(ctx context.Context, user string, msgId int) error
+	Uidl(ctx context.Context, user string) (uids []string, err error)
+	Update(ctx context.Context, user string) error
+	Lock(ctx context.Context, user string) error
+	Unlock(ctx context.Context, user string) error
+}
+
+// SecretAuthorizatorV2 is a context-aware variant of SecretAuthorizator
+type SecretAuthorizatorV2 interface {
+	Secret(ctx context.Context, user string) (exists bool, secret string, err error)
+}
+
+// ScramAuthorizatorV2 is a context-aware variant of ScramAuthorizator
+type ScramAuthorizatorV2 interface {
+	ScramCredentials(ctx context.Context, user, mechanism string) (exists bool, credentials ScramCredentials, err error)
+}
+
+// TokenVerifierV2 is a context-aware variant of TokenVerifier, see Config.TokenVerifierV2
+type TokenVerifierV2 interface {
+	VerifyToken(ctx context.Context, token string) (user string, err error)
+}
+
+// TopBackendV2 is a context-aware variant of TopBackend
+type TopBackendV2 interface {
+	Top(ctx context.Context, user string, msgId, n int) (message string, err error)
+}
+
+// ExpungeBackendV2 is a context-aware variant of ExpungeBackend
+type ExpungeBackendV2 interface {
+	Expunge(ctx context.Context, user string, msgIds []int) error
+}
+
+// ReaderBackendV2 is a context-aware variant of ReaderBackend. The context is cancelled
+// when the client disconnects, so the reader can stop reading from slow storage.
+type ReaderBackendV2 interface {
+	RetrReader(ctx context.Context, user string, msgId int) (message io.ReadCloser, err error)
+}
+
+// UserPolicyBackendV2 is a context-aware variant of UserPolicyBackend
+type UserPolicyBackendV2 interface {
+	Expire(ctx context.Context, user string) (policy string, err error)
+	LoginDelay(ctx context.Context, user string) (seconds int, err error)
+}
+
+// AdaptAuthorizator adapts Authorizator to AuthorizatorV2, ErrorAuthorizator is used
+// when implemented. Optional interfaces of adapted Authorizator remain available.
+func AdaptAuthorizator(authorizator Authorizator) AuthorizatorV2 {
+	return authorizatorAdapter{authorizator}
+}
+
+type authorizatorAdapter struct {
+	authorizator Authorizator
+}
+
+func (a authorizatorAdapter) Authorize(ctx context.Context, user, pass string) (bool, error) {
+	if authorizator, ok := a.authorizator.(ErrorAuthorizator); ok {
+		return authorizator.AuthorizeErr(user, pass)
+	}
+	return a.authorizator.Authorize(user, pass), nil
+}
+
+// AdaptBackend adapts Backend to BackendV2, context is ignored. Optional interfaces
+// of adapted Backend remain available.
+func AdaptBackend(backend Backend) BackendV2 {
+	return backendAdapter{backend}
+}
+
+type backendAdapter struct {
+	backend Backend
+}
+
+func (a backendAdapter) List(ctx context.Context, user string) ([]int, error) {
+	return a.backend.List(user)
+}
+
+func (a backendAdapter) Retr(ctx context.Context, user string, msgId int) (string, error) {
+	return a.backend.Retr(user, msgId)
+}
+
+func (a backendAdapter) Dele(ctx context.Context, user string, msgId int) error {
+	return a.backend.Dele(user, msgId)
+}
+
+func (a backendAdapter) Uidl(ctx context.Context, user string) ([]string, error) {
+	return a.backend.Uidl(user)
+}
+
+func (a backendAdapter) Update(ctx context.Context, user string) error {
+	return a.backend.Update(user)
+}
+
+func (a backendAdapter) Lock(ctx context.Context, user string) error {
+	return a.backend.Lock(user)
+}
+
+func (a backendAdapter) Unlock(ctx context.Context, user string) error {
+	return a.backend.Unlock(user)
+}
+
+// authorizatorExtension returns authorizator implementing optional interfaces
+// like SecretAuthorizator, which is adapted Authorizator if any
+func authorizatorExtension(authorizator AuthorizatorV2) interface{} {
+	if adapter, ok := authorizator.(authorizatorAdapter); ok {
+		return adapter.authorizator
+	}
+	return authorizator
+}
+
+// backendExtension returns backend implementing optional interfaces
+// like TopBackend, which is adapted Backend if any
+func backendExtension(backend BackendV2) interface{} {
+	if adapter, ok := backend.(backendAdapter); ok {
+		return adapter.backend
+	}
+	return backend
+}
+
+// Optional interfaces are detected in their context-aware variant first, the original
+// ones are adapted by ignoring the context. Nil is returned if neither is implemented.
+
+func secretExtension(authorizator AuthorizatorV2) SecretAuthorizatorV2 {
+	switch a := authorizatorExtension(authorizator).(type) {
+	case SecretAuthorizatorV2:
+		return a
+	case SecretAuthorizator:
+		return secretAdapter{a}
+	}
+	return nil
+}
+
+type secretAdapter struct {
+	authorizator SecretAuthorizator
+}
+
+func (a secretAdapter) Secret(ctx context.Context, user string) (bool, string, error) {
+	return a.authorizator.Secret(user)
+}
+
+func scramExtension(authorizator AuthorizatorV2) ScramAuthorizatorV2 {
+	switch a := authorizatorExtension(authorizator).(type) {
+	case ScramAuthorizatorV2:
+		return a
+	case ScramAuthorizator:
+		return scramAdapter{a}
+	}
+	return nil
+}
+
+type scramAdapter struct {
+	authorizator ScramAuthorizator
+}
+
+func (a scramAdapter) ScramCredentials(ctx context.Context, user, mechanism string) (bool, ScramCredentials, error) {
+	return a.authorizator.ScramCredentials(user, mechanism)
+}
+
+func adaptTokenVerifier(verifierV2 TokenVerifierV2, verifier TokenVerifier) TokenVerifierV2 {
+	if verifierV2 != nil {
+		return verifierV2
+	}
+	if verifier != nil {
+		return tokenVerifierAdapter{verifier}
+	}
+	return nil
+}
+
+type tokenVerifierAdapter struct {
+	verifier TokenVerifier
+}
+
+func (a tokenVerifierAdapter) VerifyToken(ctx context.Context, token string) (string, error) {
+	return a.verifier.VerifyToken(token)
+}
+
+func topExtension(backend BackendV2) TopBackendV2 {
+	switch b := backendExtension(backend).(type) {
+	case TopBackendV2:
+		return b
+	case TopBackend:
+		return topAdapter{b}
+	}
+	return nil
+}
+
+type topAdapter struct {
+	backend TopBackend
+}
+
+func (a topAdapter) Top(ctx context.Context, user string, msgId, n int) (string, error) {
+	return a.backend.Top(user, msgId, n)
+}
+
+func expungeExtension(backend BackendV2) ExpungeBackendV2 {
+	switch b := backendExtension(backend).(type) {
+	case ExpungeBackendV2:
+		return b
+	case ExpungeBackend:
+		return expungeAdapter{b}
+	}
+	return nil
+}
+
+type expungeAdapter struct {
+	backend ExpungeBackend
+}
+
+func (a expungeAdapter) Expunge(ctx context.Context, user string, msgIds []int) error {
+	return a.backend.Expunge(user, msgIds)
+}
+
+func readerExtension(backend BackendV2) ReaderBackendV2 {
+	switch b := backendExtension(backend).(type) {
+	case ReaderBackendV2:
+		return b
+	case ReaderBackend:
+		return readerAdapter{b}
+	}
+	return nil
+}
+
+type readerAdapter struct {
+	backend ReaderBackend
+}
+
+func (a readerAdapter) RetrReader(ctx context.Context, user string, msgId int) (io.ReadCloser, error) {
+	return a.backend.RetrReader(user, msgId)
+}
+
+func userPolicyExtension(backend BackendV2) UserPolicyBackendV2 {
+	switch b := backendExtension(backend).(type) {
+	case UserPolicyBackendV2:
+		return b
+	case UserPolicyBackend:
+		return userPolicyAdapter{b}
+	}
+	return nil
+}
+
+type userPolicyAdapter struct {
+	backend UserPolicyBackend
+}
+
+func (a userPolicyAdapter) Expire(ctx context.Context, user string) (string, error) {
+	return a.backend.Expire(user)
+}
+
+func (a userPolicyAdapter) LoginDelay(ctx context.Context, user string) (int, error) {
+	return a.backend.LoginDelay(user)
+}
+
+// SessionInfo describes client session, it's available in context passed
+// to AuthorizatorV2 and BackendV2, see SessionFromContext
+type SessionInfo struct {
+	// ID is a unique identifier of the session, e.g. for logging
+	ID string
+	// RemoteAddr is a network address of the client, which is the address sent by proxy
+	// when PROXY protocol is used
+	RemoteAddr net.Addr
+	// ProxyAddr is a network address of the proxy the client connected through, nil for
+	// direct connections
+	ProxyAddr net.Addr
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns SessionInfo of the client the context belongs to
+func SessionFromContext(ctx context.Context) (SessionInfo, bool) {
+	session, ok := ctx.Value(sessionKey{}).(SessionInfo)
+	return session, ok
+}
+
+func newSessionContext(ctx context.Context, session SessionInfo) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// newSessionId generates random session identifier
+func newSessionId() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
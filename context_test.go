@@ -0,0 +1,203 @@
+package popgun
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// contextBackend is BackendV2 recording contexts passed to it
+type contextBackend struct {
+	contexts *[]context.Context
+}
+
+func (b contextBackend) record(ctx context.Context) {
+	*b.contexts = append(*b.contexts, ctx)
+}
+
+func (b contextBackend) List(ctx context.Context, user string) ([]int, error) {
+	b.record(ctx)
+	return []int{10}, nil
+}
+
+func (b contextBackend) Retr(ctx context.Context, user string, msgId int) (string, error) {
+	b.record(ctx)
+	return "message", nil
+}
+
+func (b contextBackend) Dele(ctx context.Context, user string, msgId int) error {
+	b.record(ctx)
+	return nil
+}
+
+func (b contextBackend) Uidl(ctx context.Context, user string) ([]string, error) {
+	b.record(ctx)
+	return []string{"uid"}, nil
+}
+
+func (b contextBackend) Update(ctx context.Context, user string) error {
+	b.record(ctx)
+	return nil
+}
+
+func (b contextBackend) Lock(ctx context.Context, user string) error {
+	b.record(ctx)
+	return nil
+}
+
+func (b contextBackend) Unlock(ctx context.Context, user string) error {
+	b.record(ctx)
+	return nil
+}
+
+func (b contextBackend) Top(ctx context.Context, user string, msgId, n int) (string, error) {
+	b.record(ctx)
+	return fmt.Sprintf("top %d %d", msgId, n), nil
+}
+
+func (b contextBackend) RetrReader(ctx context.Context, user string, msgId int) (io.ReadCloser, error) {
+	b.record(ctx)
+	return io.NopCloser(strings.NewReader("streamed message")), nil
+}
+
+func (b contextBackend) Expunge(ctx context.Context, user string, msgIds []int) error {
+	b.record(ctx)
+	return nil
+}
+
+func (b contextBackend) Expire(ctx context.Context, user string) (string, error) {
+	b.record(ctx)
+	return "NEVER", nil
+}
+
+func (b contextBackend) LoginDelay(ctx context.Context, user string) (int, error) {
+	b.record(ctx)
+	return 0, nil
+}
+
+type contextAuthorizator struct {
+	contexts *[]context.Context
+}
+
+func (a contextAuthorizator) Authorize(ctx context.Context, user, pass string) (bool, error) {
+	*a.contexts = append(*a.contexts, ctx)
+	return pass == "secret", nil
+}
+
+func (a contextAuthorizator) Secret(ctx context.Context, user string) (bool, string, error) {
+	*a.contexts = append(*a.contexts, ctx)
+	return true, "secret", nil
+}
+
+func (a contextAuthorizator) ScramCredentials(ctx context.Context, user, mechanism string) (bool, ScramCredentials, error) {
+	*a.contexts = append(*a.contexts, ctx)
+	return false, ScramCredentials{}, nil
+}
+
+func (a contextAuthorizator) VerifyToken(ctx context.Context, token string) (string, error) {
+	*a.contexts = append(*a.contexts, ctx)
+	return "john", nil
+}
+
+func TestClient_handleContext(t *testing.T) {
+	var contexts []context.Context
+	client := newClientV2(contextAuthorizator{&contexts}, contextBackend{&contexts})
+	sessionTest(t, client, []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"TOP 1 2", "^\\+OK"},
+		{"", "^top 1 2\r\n$"},
+		{"", "^\\.\r\n$"},
+		{"RETR 1", "^\\+OK"},
+		{"", "^streamed message\r\n$"},
+		{"", "^\\.\r\n$"},
+	})
+
+	// Authorize, Lock, List, Uidl, Top, RetrReader and Unlock after disconnect
+	if len(contexts) != 7 {
+		t.Fatalf("Expected 7 calls with context, but got %d", len(contexts))
+	}
+	session, ok := SessionFromContext(contexts[0])
+	if !ok || session.ID == "" || session.RemoteAddr == nil {
+		t.Errorf("Expected session info in context, but got %+v", session)
+	}
+	for i, ctx := range contexts {
+		if s, _ := SessionFromContext(ctx); s.ID != session.ID {
+			t.Errorf("Expected session %s, but got %s", session.ID, s.ID)
+		}
+		// maildrop is unlocked after the session ended with context, which is not cancelled
+		if i < len(contexts)-1 && ctx.Err() != context.Canceled {
+			t.Errorf("Expected context to be cancelled after session ended, but got %v", ctx.Err())
+		}
+	}
+}
+
+func TestAdaptAuthorizator(t *testing.T) {
+	authorizator := AdaptAuthorizator(errorAuthorizator{err: ErrLoginDelay})
+	if _, err := authorizator.Authorize(context.Background(), "john", "secret"); err != ErrLoginDelay {
+		t.Errorf("Expected ErrorAuthorizator to be used, but got %v", err)
+	}
+	authorizator = AdaptAuthorizator(secretAuthorizator{"john": "secret"})
+	if ok, err := authorizator.Authorize(context.Background(), "john", "secret"); !ok || err != nil {
+		t.Errorf("Expected user to be authorized, but got %v, %v", ok, err)
+	}
+	if _, ok := authorizatorExtension(authorizator).(SecretAuthorizator); !ok {
+		t.Error("Expected SecretAuthorizator to be available through adapter")
+	}
+}
+
+func TestAdaptBackend(t *testing.T) {
+	backend := AdaptBackend(topBackend{})
+	sizes, err := backend.List(context.Background(), "john")
+	if err != nil || len(sizes) != 5 {
+		t.Errorf("Expected adapted List to return 5 messages, but got %v, %v", sizes, err)
+	}
+	if _, ok := backendExtension(backend).(TopBackend); !ok {
+		t.Error("Expected TopBackend to be available through adapter")
+	}
+	if _, ok := backendExtension(AdaptBackend(backends.DummyBackend{})).(TopBackend); ok {
+		t.Error("Expected TopBackend not to be available")
+	}
+}
+
+func TestContextExtensions(t *testing.T) {
+	var contexts []context.Context
+	backend := contextBackend{&contexts}
+	authorizator := contextAuthorizator{&contexts}
+	ctx := newSessionContext(context.Background(), SessionInfo{ID: "session"})
+
+	// context-aware variants are detected on BackendV2 and AuthorizatorV2
+	expungeExtension(backend).Expunge(ctx, "john", []int{1})
+	userPolicyExtension(backend).Expire(ctx, "john")
+	userPolicyExtension(backend).LoginDelay(ctx, "john")
+	secretExtension(authorizator).Secret(ctx, "john")
+	scramExtension(authorizator).ScramCredentials(ctx, "john", "SCRAM-SHA-256")
+	adaptTokenVerifier(authorizator, tokenVerifier{}).VerifyToken(ctx, "token")
+	if len(contexts) != 6 {
+		t.Fatalf("Expected 6 calls with context, but got %d", len(contexts))
+	}
+	for _, c := range contexts {
+		if c != ctx {
+			t.Errorf("Expected context to be passed, but got %v", c)
+		}
+	}
+
+	// original interfaces are adapted
+	legacy := AdaptBackend(topBackend{})
+	if message, err := topExtension(legacy).Top(ctx, "john", 1, 2); err != nil || !strings.HasPrefix(message, "Subject: top 1 2") {
+		t.Errorf("Expected TopBackend to be adapted, but got %q, %v", message, err)
+	}
+	if expungeExtension(legacy) != nil || readerExtension(legacy) != nil || userPolicyExtension(legacy) != nil {
+		t.Error("Expected extensions not implemented by backend to be nil")
+	}
+	if secretExtension(AdaptAuthorizator(secretAuthorizator{})) == nil {
+		t.Error("Expected SecretAuthorizator to be adapted")
+	}
+	if scramExtension(AdaptAuthorizator(secretAuthorizator{})) != nil || adaptTokenVerifier(nil, nil) != nil {
+		t.Error("Expected extensions not implemented by authorizator to be nil")
+	}
+}
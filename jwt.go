@@ -0,0 +1,304 @@
+package popgun
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned by JWTVerifier when token is malformed,
+	// has invalid signature or claims
+	ErrInvalidToken = fmt.Errorf("Invalid token")
+)
+
+// JWTVerifier is a TokenVerifier for JWT access tokens (RFC 7519) signed by keys
+// from locally configured JSON Web Key Set (RFC 7517). Supported algorithms are
+// RS256, RS384, RS512, ES256, ES384, ES512, EdDSA, HS256, HS384 and HS512.
+type JWTVerifier struct {
+	keys []jwk
+
+	// Issuer must match "iss" claim when not empty
+	Issuer string
+	// Audience must be contained in "aud" claim when not empty
+	Audience string
+	// UserClaim is a name of claim containing user name, "sub" is used when empty
+	UserClaim string
+	// Leeway is a tolerance used when validating "exp" and "nbf" claims
+	Leeway time.Duration
+
+	now func() time.Time
+}
+
+type jwk struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// NewJWTVerifier creates verifier from JSON Web Key Set
+func NewJWTVerifier(jwks []byte) (*JWTVerifier, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(jwks, &set); err != nil {
+		return nil, fmt.Errorf("Error parsing JWKS: %v", err)
+	}
+
+	v := &JWTVerifier{now: time.Now}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		var key interface{}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = parseRSAKey(k.N, k.E)
+		case "EC":
+			key, err = parseECKey(k.Crv, k.X, k.Y)
+		case "OKP":
+			key, err = parseOKPKey(k.Crv, k.X)
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			err = fmt.Errorf("unsupported key type %s", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing JWK %s: %v", k.Kid, err)
+		}
+		v.keys = append(v.keys, jwk{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	if len(v.keys) == 0 {
+		return nil, fmt.Errorf("No signing keys in JWKS")
+	}
+	return v, nil
+}
+
+func parseRSAKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+	exponent := new(big.Int).SetBytes(eb)
+	if len(nb) == 0 || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("invalid RSA key")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: int(exponent.Int64())}, nil
+}
+
+func parseECKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %s", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	yb, err := base64.RawURLEncoding.DecodeString(y)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(xb), Y: new(big.Int).SetBytes(yb)}
+	if !curve.IsOnCurve(key.X, key.Y) {
+		return nil, fmt.Errorf("invalid EC key")
+	}
+	return key, nil
+}
+
+func parseOKPKey(crv, x string) (ed25519.PublicKey, error) {
+	if crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve %s", crv)
+	}
+	xb, err := base64.RawURLEncoding.DecodeString(x)
+	if err != nil {
+		return nil, err
+	}
+	if len(xb) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 key")
+	}
+	return ed25519.PublicKey(xb), nil
+}
+
+// VerifyToken verifies signature and claims of the token and returns user from UserClaim
+func (v *JWTVerifier) VerifyToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range v.keys {
+		if header.Kid != "" && key.kid != header.Kid {
+			continue
+		}
+		if key.alg != "" && key.alg != header.Alg {
+			continue
+		}
+		if verifyJWTSignature(header.Alg, key.key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return "", fmt.Errorf("%w: signature verification failed", ErrInvalidToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return "", err
+	}
+	userClaim := v.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	user, ok := claims[userClaim].(string)
+	if !ok || user == "" {
+		return "", fmt.Errorf("%w: missing %s claim", ErrInvalidToken, userClaim)
+	}
+	return user, nil
+}
+
+func (v *JWTVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now
+	if v.now != nil {
+		now = v.now
+	}
+	t := now()
+	if exp, ok := claims["exp"].(float64); ok {
+		if !t.Before(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+			return fmt.Errorf("%w: token expired", ErrInvalidToken)
+		}
+	} else if _, present := claims["exp"]; present {
+		return fmt.Errorf("%w: invalid exp claim", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if t.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("%w: token not valid yet", ErrInvalidToken)
+		}
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return fmt.Errorf("%w: invalid issuer", ErrInvalidToken)
+	}
+	if v.Audience != "" {
+		valid := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			valid = aud == v.Audience
+		case []interface{}:
+			for _, a := range aud {
+				if a == v.Audience {
+					valid = true
+					break
+				}
+			}
+		}
+		if !valid {
+			return fmt.Errorf("%w: invalid audience", ErrInvalidToken)
+		}
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+	return nil
+}
+
+func verifyJWTSignature(alg string, key interface{}, signed, signature []byte) bool {
+	var h crypto.Hash
+	switch alg {
+	case "RS256", "ES256", "HS256":
+		h = crypto.SHA256
+	case "RS384", "ES384", "HS384":
+		h = crypto.SHA384
+	case "RS512", "ES512", "HS512":
+		h = crypto.SHA512
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(k, signed, signature)
+	default:
+		return false
+	}
+	hasher := h.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, h, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		bitSize := k.Curve.Params().BitSize
+		size := (bitSize + 7) / 8
+		curveAlg := map[int]string{256: "ES256", 384: "ES384", 521: "ES512"}[bitSize]
+		if alg != curveAlg || len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(k, digest, r, s)
+	case []byte:
+		if !strings.HasPrefix(alg, "HS") {
+			return false
+		}
+		mac := hmac.New(h.New, k)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package popgun
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testJWTKeys struct {
+	rsa     *rsa.PrivateKey
+	ec      *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+	secret  []byte
+}
+
+func newTestJWTKeys(t *testing.T) testJWTKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testJWTKeys{rsa: rsaKey, ec: ecKey, ed25519: edKey, secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func (k testJWTKeys) jwks() []byte {
+	b64 := base64.RawURLEncoding.EncodeToString
+	return []byte(fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": "%s", "e": "%s"},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": "%s", "y": "%s"},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "%s"},
+		{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": "%s"},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"}
+	]}`,
+		b64(k.rsa.N.Bytes()), b64(big.NewInt(int64(k.rsa.E)).Bytes()),
+		b64(k.ec.X.FillBytes(make([]byte, 32))), b64(k.ec.Y.FillBytes(make([]byte, 32))),
+		b64(k.ed25519.Public().(ed25519.PublicKey)),
+		b64(k.secret),
+	))
+}
+
+// sign creates JWT signed by key of given algorithm
+func (k testJWTKeys) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	b64 := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "EdDSA":
+		signature = ed25519.Sign(k.ed25519, []byte(signed))
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(signature)
+}
+
+func TestJWTVerifier_VerifyToken(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.Issuer = "https://sso.example.com"
+	verifier.Audience = "pop3"
+	now := time.Unix(1700000000, 0)
+	verifier.now = func() time.Time {
+		return now
+	}
+
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "john",
+			"iss": "https://sso.example.com",
+			"aud": []string{"webmail", "pop3"},
+			"exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(-time.Hour).Unix(),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa", claims(nil)), true},
+		{"ES256", keys.sign(t, "ES256", "ec", claims(nil)), true},
+		{"EdDSA", keys.sign(t, "EdDSA", "ed", claims(nil)), true},
+		{"HS256", keys.sign(t, "HS256", "hmac", claims(nil)), true},
+		{"without kid", keys.sign(t, "ES256", "", claims(nil)), true},
+		{"string audience", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			c["aud"] = "pop3"
+		})), true},
+		{"wrong kid", keys.sign(t, "RS256", "ec", claims(nil)), false},
+		{"algorithm not allowed for key", keys.sign(t, "HS256", "rsa", claims(nil)), false},
+		{"encryption key", keys.sign(t, "RS256", "enc", claims(nil)), false},
+		{"expired", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-time.Minute).Unix()
+		})), false},
+		{"not valid yet", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			c["nbf"] = now.Add(time.Minute).Unix()
+		})), false},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		})), false},
+		{"wrong audience", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			c["aud"] = "imap"
+		})), false},
+		{"missing subject", keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+			delete(c, "sub")
+		})), false},
+		{"malformed", "not.a.token", false},
+		{"unsigned", keys.sign(t, "none", "", claims(nil)), false},
+	}
+
+	for _, testCase := range testCases {
+		user, err := verifier.VerifyToken(testCase.token)
+		if testCase.valid {
+			if err != nil || user != "john" {
+				t.Errorf("%s: expected user 'john', but got '%s', %v", testCase.name, user, err)
+			}
+		} else if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: expected invalid token error, but got '%s', %v", testCase.name, user, err)
+		}
+	}
+
+	//tampered payload
+	token := keys.sign(t, "RS256", "rsa", claims(nil))
+	other := keys.sign(t, "RS256", "rsa", claims(func(c map[string]interface{}) {
+		c["sub"] = "admin"
+	}))
+	tokenParts := strings.Split(token, ".")
+	otherParts := strings.Split(other, ".")
+	tampered := tokenParts[0] + "." + otherParts[1] + "." + tokenParts[2]
+	if _, err := verifier.VerifyToken(tampered); err == nil {
+		t.Error("Expected tampered token to be rejected")
+	}
+}
+
+func TestJWTVerifier_UserClaim(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier.UserClaim = "email"
+	token := keys.sign(t, "HS256", "hmac", map[string]interface{}{"sub": "1234", "email": "john@example.com"})
+	user, err := verifier.VerifyToken(token)
+	if err != nil || user != "john@example.com" {
+		t.Errorf("Expected user 'john@example.com', but got '%s', %v", user, err)
+	}
+}
+
+func TestNewJWTVerifier(t *testing.T) {
+	invalid := []string{
+		`not json`,
+		`{"keys": []}`,
+		`{"keys": [{"kty": "unknown"}]}`,
+		`{"keys": [{"kty": "EC", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`,
+		`{"keys": [{"kty": "OKP", "crv": "Ed25519", "x": "AQ"}]}`,
+	}
+	for _, jwks := range invalid {
+		if _, err := NewJWTVerifier([]byte(jwks)); err == nil {
+			t.Errorf("Expected error for JWKS '%s', but got none", jwks)
+		}
+	}
+}
@@ -6,11 +6,20 @@ package popgun
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,46 +30,281 @@ const (
 )
 
 type Config struct {
+	// Listeners define interfaces to listen on, each with its own TLS mode, banner
+	// and auth policy. ListenInterface and TLSListenInterface are listened on as well
+	// if set, random port is used only if no interface is configured at all.
+	Listeners []ListenerConfig `json:"listeners"`
+
 	ListenInterface string `json:"listen_interface"`
+	// TLSListenInterface is an interface for POP3S connections, which are
+	// wrapped in TLS before the greeting (implicit TLS, usually port 995)
+	TLSListenInterface string `json:"tls_listen_interface"`
+
+	// TLSCertFile and TLSKeyFile are PEM encoded certificate and key used
+	// for TLS connections when TLSConfig is not set
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// TLSConfig enables STLS command (RFC 2595) on plaintext connections
+	// and is used for POP3S connections
+	TLSConfig *tls.Config `json:"-"`
+
+	// DisablePlaintextAuth refuses USER/PASS and other authentication methods
+	// sending passwords in clear text until the connection is secured by TLS,
+	// listeners without TLS are refused then unless they allow plaintext auth
+	DisablePlaintextAuth bool `json:"disable_plaintext_auth"`
+
+	// TokenVerifier enables XOAUTH2 and OAUTHBEARER authentication mechanisms
+	TokenVerifier TokenVerifier `json:"-"`
+	// TokenVerifierV2 is a context-aware variant of TokenVerifier used instead of it when set
+	TokenVerifierV2 TokenVerifierV2 `json:"-"`
+
+	// Expire is announced in EXPIRE capability (RFC 2449) - number of days messages
+	// are kept on server after being retrieved or "NEVER". Nothing is announced if empty.
+	Expire string `json:"expire"`
+	// LoginDelay is minimum number of seconds between logins announced in LOGIN-DELAY capability
+	LoginDelay int `json:"login_delay"`
+	// UTF8 enables UTF8 command (RFC 6856) for backends serving internationalized messages
+	UTF8 bool `json:"utf8"`
+
+	// ZeroBasedMessageIds makes message IDs passed to Backend start at 0 instead of 1.
+	// Message numbers used by clients always start at 1, this is a compatibility option
+	// for backends using message ID as an index to List() result.
+	ZeroBasedMessageIds bool `json:"zero_based_message_ids"`
+}
+
+// TLSMode defines how TLS is used on a listener
+type TLSMode string
+
+const (
+	// TLSModeSTLS serves plaintext connections, which can be upgraded by STLS command
+	// when TLS is configured. It's the default mode.
+	TLSModeSTLS TLSMode = "stls"
+	// TLSModeImplicit wraps connections in TLS before the greeting (POP3S)
+	TLSModeImplicit TLSMode = "implicit"
+	// TLSModeNone serves plaintext connections without STLS
+	TLSModeNone TLSMode = "none"
+)
+
+// AuthPolicy defines whether clients may authenticate before the connection is secured by TLS
+type AuthPolicy string
+
+const (
+	// AuthPolicyDefault follows Config.DisablePlaintextAuth
+	AuthPolicyDefault AuthPolicy = ""
+	// AuthPolicyPlaintext allows USER/PASS and other methods sending passwords in clear text
+	AuthPolicyPlaintext AuthPolicy = "plaintext"
+	// AuthPolicyTLSRequired refuses authentication sending passwords in clear text
+	// until the connection is secured by TLS
+	AuthPolicyTLSRequired AuthPolicy = "tls_required"
+)
+
+// ListenerConfig defines single listener of the server
+type ListenerConfig struct {
+	// Address is an interface (ip address) and port to listen on
+	Address string `json:"address"`
+	// TLSMode defaults to TLSModeSTLS
+	TLSMode TLSMode `json:"tls_mode"`
+	// Banner replaces default text of the greeting, APOP timestamp is appended if needed
+	Banner     string     `json:"banner"`
+	AuthPolicy AuthPolicy `json:"auth_policy"`
+
+	// ProxyProtocol enables PROXY protocol (version 1 and 2) used by load balancers like HAProxy
+	// to pass address of the client. The header is read before the greeting only from connections
+	// of TrustedProxies (CIDR list), other connections are served as direct ones.
+	ProxyProtocol  bool     `json:"proxy_protocol"`
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// listenerConfigs returns all listeners defined by the configuration
+func (c Config) listenerConfigs() []ListenerConfig {
+	var configs []ListenerConfig
+	if c.ListenInterface != "" || (c.TLSListenInterface == "" && len(c.Listeners) == 0) {
+		configs = append(configs, ListenerConfig{Address: c.ListenInterface})
+	}
+	if c.TLSListenInterface != "" {
+		configs = append(configs, ListenerConfig{Address: c.TLSListenInterface, TLSMode: TLSModeImplicit})
+	}
+	return append(configs, c.Listeners...)
+}
+
+// tlsConfig returns TLS configuration, which is either given directly
+// or loaded from certificate files. Nil is returned if TLS is not configured.
+func (cfg Config) tlsConfig() (*tls.Config, error) {
+	if cfg.TLSConfig != nil {
+		return cfg.TLSConfig, nil
+	}
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
 
 type Authorizator interface {
 	Authorize(user, pass string) bool
 }
 
+// ErrorAuthorizator is an optional interface of Authorizator, which is used instead
+// of Authorize when implemented. Returned errors carrying response code (e.g. ErrLoginDelay)
+// are reported to the client, see ResponseCoder.
+type ErrorAuthorizator interface {
+	AuthorizeErr(user, pass string) (ok bool, err error)
+}
+
+// SecretAuthorizator is an optional interface of Authorizator. When implemented,
+// APOP command is enabled and a timestamp is included in the greeting.
+type SecretAuthorizator interface {
+	// Secret returns shared secret (e.g. plaintext password) of given user.
+	Secret(user string) (exists bool, secret string, err error)
+}
+
+// Backend provides access to maildrops. Message IDs are message numbers used by clients,
+// i.e. position of the message in List() result starting at 1 (see Config.ZeroBasedMessageIds).
+// List and Uidl are called once after the maildrop is locked and the session is served from
+// this snapshot. Messages deleted during the session are tracked by the client as well.
 type Backend interface {
-	Stat(user string) (messages, octets int, err error)
 	List(user string) (octets []int, err error)
-	ListMessage(user string, msgId int) (exists bool, octets int, err error)
 	Retr(user string, msgId int) (message string, err error)
+	// Dele permanently deletes message, it's called in UPDATE state for all messages marked
+	// as deleted during the session in descending order unless ExpungeBackend is implemented
 	Dele(user string, msgId int) error
-	Rset(user string) error
 	Uidl(user string) (uids []string, err error)
-	UidlMessage(user string, msgId int) (exists bool, uid string, err error)
 	Update(user string) error
 	Lock(user string) error
 	Unlock(user string) error
 }
 
+// TopBackend is an optional interface of Backend. When not implemented, TOP command
+// retrieves whole message using Retr and splits it.
+type TopBackend interface {
+	// Top returns headers of the message, blank line separating headers from the body
+	// and first n lines of the body, see Retr for message ID details.
+	Top(user string, msgId, n int) (message string, err error)
+}
+
+// ExpungeBackend is an optional interface of Backend. When implemented, Expunge is called
+// instead of Dele for each message when the session enters UPDATE state.
+type ExpungeBackend interface {
+	// Expunge permanently deletes messages marked as deleted during the session.
+	// Message IDs are sorted in ascending order, Update is called afterwards.
+	Expunge(user string, msgIds []int) error
+}
+
+// ReaderBackend is an optional interface of Backend. When implemented, RETR command
+// streams the message to the client instead of calling Retr, so large messages
+// don't need to be held in memory.
+type ReaderBackend interface {
+	// RetrReader returns reader of whole message, see Retr for message ID details.
+	// Line endings are normalized to CRLF and lines are dot-stuffed by the server.
+	RetrReader(user string, msgId int) (message io.ReadCloser, err error)
+}
+
+// UserPolicyBackend is an optional interface of Backend. When implemented, EXPIRE and
+// LOGIN-DELAY capabilities are announced per user after login (RFC 2449).
+type UserPolicyBackend interface {
+	// Expire returns number of days messages of the user are kept on server after being
+	// retrieved or "NEVER". Config.Expire is used if empty.
+	Expire(user string) (policy string, err error)
+	// LoginDelay returns minimum number of seconds between logins of the user.
+	// Config.LoginDelay is used if zero.
+	LoginDelay(user string) (seconds int, err error)
+}
+
 var (
 	ErrInvalidState = fmt.Errorf("Invalid state")
+
+	// ErrMailboxInUse should be returned by Backend.Lock when maildrop is locked by another session,
+	// backends.ErrMailboxInUse returned by bundled backends matches it by errors.Is
+	ErrMailboxInUse = NewResponseError("IN-USE", "Mailbox is locked by another session")
+	// ErrLoginDelay should be returned when user logs in more often than allowed by LOGIN-DELAY
+	ErrLoginDelay = NewResponseError("LOGIN-DELAY", "Minimum time between logins has not elapsed")
+	// ErrTemporary is a failure which is likely to be resolved by itself, e.g. storage outage
+	ErrTemporary = NewResponseError("SYS/TEMP", "Temporary system failure")
+	// ErrPermanent is a failure which requires action of administrator
+	ErrPermanent = NewResponseError("SYS/PERM", "Permanent system failure")
 )
 
+// ResponseCoder is implemented by errors carrying extended response code (RFC 2449, RFC 3206).
+// When Backend or Authorizator returns such error, the code is sent to the client
+// in brackets, e.g. "-ERR [IN-USE] ...". Errors can be wrapped.
+type ResponseCoder interface {
+	ResponseCode() string
+}
+
+// ResponseError is an error carrying extended response code
+type ResponseError struct {
+	Code    string
+	Message string
+}
+
+// NewResponseError creates error with extended response code, e.g. "SYS/TEMP"
+func NewResponseError(code, msg string) error {
+	return &ResponseError{Code: code, Message: msg}
+}
+
+func (e *ResponseError) Error() string {
+	return e.Message
+}
+
+func (e *ResponseError) ResponseCode() string {
+	return e.Code
+}
+
+// responseCode returns extended response code of the error or empty string
+func responseCode(err error) string {
+	var coder ResponseCoder
+	if errors.As(err, &coder) {
+		return coder.ResponseCode()
+	}
+	return ""
+}
+
 //---------------CLIENT
 
 type Client struct {
-	commands     map[string]Executable
-	printer      *Printer
-	isAlive      bool
-	currentState int
-	authorizator Authorizator
-	backend      Backend
-	user         string
-	pass         string
-	lastCommand  string
+	commands             map[string]Executable
+	saslMechanisms       map[string]SaslMechanism
+	conn                 net.Conn
+	reader               *bufio.Reader
+	printer              *Printer
+	tlsConfig            *tls.Config
+	tlsActive            bool
+	disablePlaintextAuth bool
+	banner               string
+	proxyAddr            net.Addr
+	expire               string
+	loginDelay           int
+	zeroBasedMessageIds  bool
+	isAlive              bool
+	currentState         int
+	authorizator         AuthorizatorV2
+	backend              BackendV2
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	inShutdown           *atomic.Bool
+	mu                   sync.Mutex
+	user                 string
+	pass                 string
+	lastCommand          string
+	timestamp            string
+	maildrop             maildrop
+	deleted              map[int]bool
+}
+
+// maildrop is a snapshot of user's maildrop taken at login
+type maildrop struct {
+	sizes []int
+	uids  []string
 }
 
 func newClient(authorizator Authorizator, backend Backend) *Client {
+	return newClientV2(AdaptAuthorizator(authorizator), AdaptBackend(backend))
+}
+
+func newClientV2(authorizator AuthorizatorV2, backend BackendV2) *Client {
 	commands := make(map[string]Executable)
 
 	commands["QUIT"] = QuitCommand{}
@@ -69,65 +313,224 @@ func newClient(authorizator Authorizator, backend Backend) *Client {
 	commands["STAT"] = StatCommand{}
 	commands["LIST"] = ListCommand{}
 	commands["RETR"] = RetrCommand{}
+	commands["TOP"] = TopCommand{}
 	commands["DELE"] = DeleCommand{}
 	commands["NOOP"] = NoopCommand{}
 	commands["RSET"] = RsetCommand{}
 	commands["UIDL"] = UidlCommand{}
 	commands["CAPA"] = CapaCommand{}
+	commands["STLS"] = StlsCommand{}
+	commands["AUTH"] = AuthCommand{}
+
+	saslMechanisms := make(map[string]SaslMechanism)
+
+	saslMechanisms["PLAIN"] = PlainMechanism{}
+	saslMechanisms["LOGIN"] = LoginMechanism{}
+
+	var timestamp string
+	if secretExtension(authorizator) != nil {
+		commands["APOP"] = ApopCommand{}
+		saslMechanisms["CRAM-MD5"] = CramMD5Mechanism{}
+		timestamp = newTimestamp()
+	}
+	if scramExtension(authorizator) != nil {
+		saslMechanisms["SCRAM-SHA-1"] = ScramMechanism{Name: "SCRAM-SHA-1", Hash: sha1.New}
+		saslMechanisms["SCRAM-SHA-256"] = ScramMechanism{Name: "SCRAM-SHA-256", Hash: sha256.New}
+	}
 
 	return &Client{
-		commands:     commands,
-		currentState: STATE_AUTHORIZATION,
-		authorizator: authorizator,
-		backend:      backend,
+		commands:       commands,
+		saslMechanisms: saslMechanisms,
+		currentState:   STATE_AUTHORIZATION,
+		authorizator:   authorizator,
+		backend:        backend,
+		ctx:            context.Background(),
+		timestamp:      timestamp,
+		deleted:        make(map[int]bool),
 	}
 }
 
-func (c Client) handle(conn net.Conn) {
-	defer conn.Close()
+var timestampCounter uint64
+
+// newTimestamp generates unique msg-id used for APOP in <pid.counter.clock@hostname> format
+func newTimestamp() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	counter := atomic.AddUint64(&timestampCounter, 1)
+	return fmt.Sprintf("<%d.%d.%d@%s>", os.Getpid(), counter, time.Now().UnixNano(), hostname)
+}
+
+func (c *Client) handle(conn net.Conn) {
+	// connection might be replaced by TLS connection after STLS
+	defer func() {
+		c.conn.Close()
+	}()
+	// context is cancelled when the session ends
+	ctx, cancel := context.WithCancel(newSessionContext(c.ctx, SessionInfo{
+		ID:         newSessionId(),
+		RemoteAddr: conn.RemoteAddr(),
+		ProxyAddr:  c.proxyAddr,
+	}))
+	defer cancel()
+	c.ctx = ctx
+
 	conn.SetReadDeadline(time.Now().Add(1 * time.Minute))
-	c.printer = NewPrinter(conn)
+	c.mu.Lock()
+	c.cancel = cancel
+	c.mu.Unlock()
+	c.setConn(conn)
+	if _, ok := conn.(*tls.Conn); ok {
+		c.tlsActive = true
+	}
 
 	c.isAlive = true
-	reader := bufio.NewReader(conn)
 
-	c.printer.Welcome()
+	if c.banner != "" {
+		c.printer.Ok("%s", strings.TrimSpace(c.banner+" "+c.timestamp))
+	} else if c.timestamp != "" {
+		c.printer.WelcomeWithTimestamp(c.timestamp)
+	} else {
+		c.printer.Welcome()
+	}
+	c.printer.Flush()
 
 	for c.isAlive {
+		if c.shuttingDown() {
+			c.printer.ErrCode("SYS/TEMP", "server shutting down")
+			c.printer.Flush()
+			break
+		}
+
 		// according to RFC commands are terminated by CRLF, but we are removing \r in parseInput
-		input, err := reader.ReadString('\n')
+		input, err := c.reader.ReadString('\n')
 		if err != nil {
+			if c.shuttingDown() {
+				// read was interrupted by Server.Shutdown
+				continue
+			}
 			if err == io.EOF {
 				log.Print("Connection closed by client")
 			} else {
 				log.Print("Error reading input: ", err)
 			}
-			if len(c.user) > 0 {
-				log.Printf("Unlocking user %s due to connection error ", c.user)
-				c.backend.Unlock(c.user)
-			}
 			break
 		}
 
-		cmd, args := c.parseInput(input)
-		exec, ok := c.commands[cmd]
-		if !ok {
-			c.printer.Err("Invalid command %s", cmd)
-			log.Printf("Invalid command: %s", cmd)
-			continue
-		}
-		state, err := exec.Run(&c, args)
-		if err != nil {
-			c.printer.Err("Error executing command %s", cmd)
-			log.Print("Error executing command: ", err)
-			continue
+		c.execute(input)
+
+		// responses to pipelined commands are sent at once when all of them
+		// are processed (RFC 2449)
+		if !c.isAlive || c.reader.Buffered() == 0 {
+			c.printer.Flush()
 		}
-		c.lastCommand = cmd
-		c.currentState = state
 	}
+
+	// session ended without QUIT, changes are discarded
+	if c.currentState == STATE_TRANSACTION {
+		log.Printf("Unlocking user %s, session ended without QUIT", c.user)
+		c.backend.Unlock(context.WithoutCancel(c.ctx), c.user)
+	}
+}
+
+// shuttingDown returns whether server is shutting down and the session should end
+func (c *Client) shuttingDown() bool {
+	return c.inShutdown != nil && c.inShutdown.Load()
+}
+
+// interrupt makes pending read of client input return immediately
+func (c *Client) interrupt() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// close closes client connection and cancels session context
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// execute runs single command given by client input
+func (c *Client) execute(input string) {
+	cmd, args := c.parseInput(input)
+	exec, ok := c.commands[cmd]
+	if !ok {
+		c.printer.Err("Invalid command %s", cmd)
+		log.Printf("Invalid command: %s", cmd)
+		return
+	}
+	state, err := exec.Run(c, args)
+	if err != nil {
+		c.printer.ErrCode(responseCode(err), "Error executing command %s", cmd)
+		log.Print("Error executing command: ", err)
+		return
+	}
+	c.lastCommand = cmd
+	c.currentState = state
+}
+
+// setConn sets connection used for communication with client. Any buffered input
+// of previous connection is discarded.
+func (c *Client) setConn(conn net.Conn) {
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	c.reader = bufio.NewReader(conn)
+	c.printer = NewPrinter(conn)
+}
+
+// startTLS upgrades current plaintext connection to TLS according to RFC 2595
+func (c *Client) startTLS() error {
+	if err := c.printer.Flush(); err != nil {
+		return err
+	}
+	tlsConn := tls.Server(c.conn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.setConn(tlsConn)
+	c.tlsActive = true
+	return nil
+}
+
+// Context returns context of the session, which is cancelled when the client disconnects.
+// Custom commands should pass it to long running operations.
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+// RemoteAddr returns network address of the client, which is the address sent by proxy
+// when PROXY protocol is used
+func (c *Client) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.RemoteAddr()
+}
+
+// authorize checks user credentials using Authorizator
+func (c *Client) authorize(user, pass string) (bool, error) {
+	return c.authorizator.Authorize(c.ctx, user, pass)
 }
 
-func (c Client) parseInput(input string) (string, []string) {
+// plaintextAuthAllowed returns whether client may send password in clear text
+func (c *Client) plaintextAuthAllowed() bool {
+	return c.tlsActive || !c.disablePlaintextAuth
+}
+
+func (c *Client) parseInput(input string) (string, []string) {
 	input = strings.Trim(input, "\r \n")
 	cmd := strings.Split(input, " ")
 	return strings.ToUpper(cmd[0]), cmd[1:]
@@ -135,77 +538,456 @@ func (c Client) parseInput(input string) (string, []string) {
 
 //---------------SERVER
 
+// ErrServerClosed is returned by accept loop after Server.Shutdown is called
+var ErrServerClosed = errors.New("popgun: Server closed")
+
 type Server struct {
-	listener net.Listener
-	config   Config
-	auth     Authorizator
-	backend  Backend
+	tlsConfig      *tls.Config
+	config         Config
+	auth           AuthorizatorV2
+	backend        BackendV2
+	saslMechanisms map[string]SaslMechanism
+	commands       map[string]Executable
+
+	initOnce   sync.Once
+	initErr    error
+	mu         sync.Mutex
+	inShutdown atomic.Bool
+	listeners  map[net.Listener]struct{}
+	clients    map[*Client]struct{}
+	sessions   sync.WaitGroup
 }
 
 func NewServer(cfg Config, auth Authorizator, backend Backend) *Server {
-	return &Server{
-		config:  cfg,
-		auth:    auth,
-		backend: backend,
+	return NewServerV2(cfg, AdaptAuthorizator(auth), AdaptBackend(backend))
+}
+
+// NewServerV2 creates server using context-aware authorizator and backend
+func NewServerV2(cfg Config, auth AuthorizatorV2, backend BackendV2) *Server {
+	s := &Server{
+		config:         cfg,
+		auth:           auth,
+		backend:        backend,
+		saslMechanisms: make(map[string]SaslMechanism),
+		commands:       make(map[string]Executable),
+		listeners:      make(map[net.Listener]struct{}),
+		clients:        make(map[*Client]struct{}),
+	}
+	if cfg.UTF8 {
+		s.RegisterCommand("UTF8", Utf8Command{})
 	}
+	if cfg.TokenVerifier != nil || cfg.TokenVerifierV2 != nil {
+		s.RegisterSaslMechanism("XOAUTH2", XOAuth2Mechanism{Verifier: cfg.TokenVerifier, VerifierV2: cfg.TokenVerifierV2})
+		s.RegisterSaslMechanism("OAUTHBEARER", OAuthBearerMechanism{Verifier: cfg.TokenVerifier, VerifierV2: cfg.TokenVerifierV2})
+	}
+	return s
 }
 
-func (s Server) Start() error {
+// RegisterSaslMechanism makes mechanism available via AUTH command. Built-in
+// mechanisms can be replaced by registering a mechanism with the same name.
+// Mechanisms has to be registered before the server is started.
+func (s *Server) RegisterSaslMechanism(name string, mech SaslMechanism) {
+	s.saslMechanisms[strings.ToUpper(name)] = mech
+}
 
-	var err error
-	s.listener, err = net.Listen("tcp", s.config.ListenInterface)
+// RegisterCommand adds custom command or replaces built-in command with the same name.
+// Commands implementing Capable interface are announced in CAPA response.
+// Commands has to be registered before the server is started.
+func (s *Server) RegisterCommand(name string, cmd Executable) {
+	s.commands[strings.ToUpper(name)] = cmd
+}
+
+// Start listens on configured interfaces and serves clients in background, see ListenAndServe
+func (s *Server) Start() error {
+	listeners, err := s.listen()
 	if err != nil {
-		log.Printf("Error: could not listen on %s", s.config.ListenInterface)
 		return err
 	}
+	for listener, options := range listeners {
+		go func(listener net.Listener, options ListenerConfig) {
+			if err := s.ServeListener(listener, options); err != ErrServerClosed {
+				log.Printf("Error: stopped listening on %s: %v", listener.Addr(), err)
+			}
+		}(listener, options)
+	}
+	return nil
+}
 
-	go func() {
-		log.Printf("Server listening on: %s\n", s.config.ListenInterface)
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil {
-				log.Println("Error: could not accept connection: ", err)
-				continue
+// ListenAndServe listens on configured interfaces and serves clients. It blocks until
+// Shutdown is called, in which case ErrServerClosed is returned, or any listener fails.
+func (s *Server) ListenAndServe() error {
+	listeners, err := s.listen()
+	if err != nil {
+		return err
+	}
+	return s.serveAll(listeners)
+}
+
+// init loads TLS configuration before the first listener is served
+func (s *Server) init() error {
+	s.initOnce.Do(func() {
+		s.tlsConfig, s.initErr = s.config.tlsConfig()
+	})
+	return s.initErr
+}
+
+// listen creates listeners on configured interfaces
+func (s *Server) listen() (map[net.Listener]ListenerConfig, error) {
+	if err := s.init(); err != nil {
+		return nil, err
+	}
+	configs := s.config.listenerConfigs()
+	for _, cfg := range configs {
+		if err := s.checkListenerConfig(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	listeners := make(map[net.Listener]ListenerConfig)
+	for _, cfg := range configs {
+		listener, err := net.Listen("tcp", cfg.Address)
+		if err != nil {
+			log.Printf("Error: could not listen on %s", cfg.Address)
+			for l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners[listener] = cfg
+	}
+	return listeners, nil
+}
+
+// checkListenerConfig validates listener configuration against loaded TLS configuration
+func (s *Server) checkListenerConfig(cfg ListenerConfig) error {
+	switch cfg.TLSMode {
+	case "", TLSModeSTLS, TLSModeNone:
+	case TLSModeImplicit:
+		if s.tlsConfig == nil {
+			return fmt.Errorf("TLS configuration is required to listen on %s", cfg.Address)
+		}
+	default:
+		return fmt.Errorf("unknown TLS mode %q of listener %s", cfg.TLSMode, cfg.Address)
+	}
+	authPolicy := cfg.AuthPolicy
+	if authPolicy == AuthPolicyDefault && s.config.DisablePlaintextAuth {
+		authPolicy = AuthPolicyTLSRequired
+	}
+	switch authPolicy {
+	case AuthPolicyDefault, AuthPolicyPlaintext:
+	case AuthPolicyTLSRequired:
+		if s.tlsConfig == nil || cfg.TLSMode == TLSModeNone {
+			return fmt.Errorf("TLS is required for authentication, but not available on %s", cfg.Address)
+		}
+	default:
+		return fmt.Errorf("unknown auth policy %q of listener %s", cfg.AuthPolicy, cfg.Address)
+	}
+	if cfg.ProxyProtocol {
+		if len(cfg.TrustedProxies) == 0 {
+			return fmt.Errorf("trusted proxies are required for PROXY protocol on %s", cfg.Address)
+		}
+		if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveAll serves all listeners until one of them returns, the rest is closed then
+func (s *Server) serveAll(listeners map[net.Listener]ListenerConfig) error {
+	errs := make(chan error, len(listeners))
+	for listener, cfg := range listeners {
+		go func(listener net.Listener, cfg ListenerConfig) {
+			errs <- s.ServeListener(listener, cfg)
+		}(listener, cfg)
+	}
+	err := <-errs
+	for listener := range listeners {
+		listener.Close()
+	}
+	for i := 1; i < len(listeners); i++ {
+		<-errs
+	}
+	return err
+}
+
+// Serve accepts connections on listener and serves clients, listener is closed on return.
+// It blocks until Shutdown is called, in which case ErrServerClosed is returned, or listener
+// fails. Listener wrapped by tls.NewListener can be used for POP3S connections.
+func (s *Server) Serve(listener net.Listener) error {
+	return s.ServeListener(listener, ListenerConfig{})
+}
+
+// ServeListener is like Serve, but clients are served with TLS mode, banner and auth policy
+// of the listener configuration. Address of the configuration is ignored.
+func (s *Server) ServeListener(listener net.Listener, cfg ListenerConfig) error {
+	defer listener.Close()
+	if err := s.init(); err != nil {
+		return err
+	}
+	if cfg.Address == "" {
+		cfg.Address = listener.Addr().String()
+	}
+	if err := s.checkListenerConfig(cfg); err != nil {
+		return err
+	}
+	tlsConfig := s.tlsConfig
+	if cfg.TLSMode == TLSModeNone {
+		tlsConfig = nil
+	}
+	trustedProxies, _ := parseTrustedProxies(cfg.TrustedProxies)
+	if !s.trackListener(listener) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(listener)
+
+	log.Printf("Server listening on: %s\n", listener.Addr())
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.inShutdown.Load() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// e.g. too many open files, retry with increasing delay
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("Error: could not accept connection: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+
+		c := newClientV2(s.auth, s.backend)
+		s.configureClient(c)
+		c.tlsConfig = tlsConfig
+		c.banner = cfg.Banner
+		switch cfg.AuthPolicy {
+		case AuthPolicyPlaintext:
+			c.disablePlaintextAuth = false
+		case AuthPolicyTLSRequired:
+			c.disablePlaintextAuth = true
+		}
+		if !s.trackClient(c) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrackClient(c)
+			if cfg.ProxyProtocol {
+				proxied, err := acceptProxy(conn, trustedProxies)
+				if err != nil {
+					log.Printf("Error: %v", err)
+					conn.Close()
+					return
+				}
+				if proxied != conn {
+					c.proxyAddr = conn.RemoteAddr()
+				}
+				conn = proxied
+			}
+			// TLS handshake follows PROXY protocol header
+			if cfg.TLSMode == TLSModeImplicit {
+				conn = tls.Server(conn, tlsConfig)
 			}
+			c.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
 
-			c := newClient(s.auth, s.backend)
-			go c.handle(conn)
+func (s *Server) untrackListener(listener net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, listener)
+}
+
+// trackClient registers client session, false is returned when server is shutting down
+func (s *Server) trackClient(c *Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown.Load() {
+		return false
+	}
+	s.clients[c] = struct{}{}
+	s.sessions.Add(1)
+	return true
+}
+
+func (s *Server) untrackClient(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+	s.sessions.Done()
+}
+
+// Shutdown gracefully shuts down the server. Listeners are closed, idle clients are notified
+// by "-ERR [SYS/TEMP] server shutting down" and commands in progress, e.g. QUIT updating
+// maildrop, are finished before clients are disconnected. Sessions in TRANSACTION state are
+// unlocked without update. When ctx expires first, remaining connections are closed
+// and context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+
+	s.mu.Lock()
+	var err error
+	for listener := range s.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
+		delete(s.listeners, listener)
+	}
+	for c := range s.clients {
+		c.interrupt()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
 	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for c := range s.clients {
+			c.close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
 
-	return nil
+// configureClient applies server configuration and registered extensions to new client
+func (s *Server) configureClient(c *Client) {
+	c.inShutdown = &s.inShutdown
+	c.tlsConfig = s.tlsConfig
+	c.disablePlaintextAuth = s.config.DisablePlaintextAuth
+	c.expire = s.config.Expire
+	c.loginDelay = s.config.LoginDelay
+	c.zeroBasedMessageIds = s.config.ZeroBasedMessageIds
+	for name, mech := range s.saslMechanisms {
+		c.saslMechanisms[name] = mech
+	}
+	for name, cmd := range s.commands {
+		c.commands[name] = cmd
+	}
 }
 
 //---------------PRINTER
 
+// Printer writes responses to the client. Responses are buffered until Flush is called.
 type Printer struct {
-	conn net.Conn
+	conn   net.Conn
+	writer *bufio.Writer
 }
 
 func NewPrinter(conn net.Conn) *Printer {
-	return &Printer{conn}
+	return &Printer{conn, bufio.NewWriter(conn)}
+}
+
+// Flush sends all buffered responses to the client
+func (p Printer) Flush() error {
+	return p.writer.Flush()
 }
 
 func (p Printer) Welcome() {
-	fmt.Fprintf(p.conn, "+OK POPgun POP3 server ready\r\n")
+	fmt.Fprintf(p.writer, "+OK POPgun POP3 server ready\r\n")
+}
+
+// WelcomeWithTimestamp prints greeting including APOP timestamp, see RFC 1939 section 7
+func (p Printer) WelcomeWithTimestamp(timestamp string) {
+	fmt.Fprintf(p.writer, "+OK POPgun POP3 server ready %s\r\n", timestamp)
 }
 
 func (p Printer) Ok(msg string, a ...interface{}) {
-	fmt.Fprintf(p.conn, "+OK %s\r\n", fmt.Sprintf(msg, a...))
+	fmt.Fprintf(p.writer, "+OK %s\r\n", fmt.Sprintf(msg, a...))
 }
 
 func (p Printer) Err(msg string, a ...interface{}) {
-	fmt.Fprintf(p.conn, "-ERR %s\r\n", fmt.Sprintf(msg, a...))
+	fmt.Fprintf(p.writer, "-ERR %s\r\n", fmt.Sprintf(msg, a...))
+}
+
+// Continue prints continuation line used during SASL authentication exchange
+func (p Printer) Continue(msg string) {
+	fmt.Fprintf(p.writer, "+ %s\r\n", msg)
+}
+
+// ErrCode prints error with extended response code (RFC 2449), e.g. "-ERR [IN-USE] ...".
+// The code is omitted if empty.
+func (p Printer) ErrCode(code, msg string, a ...interface{}) {
+	if code == "" {
+		p.Err(msg, a...)
+		return
+	}
+	fmt.Fprintf(p.writer, "-ERR [%s] %s\r\n", code, fmt.Sprintf(msg, a...))
 }
 
 func (p Printer) MultiLine(msgs []string) {
 	for _, line := range msgs {
 		line := strings.Trim(line, "\r")
 		if strings.HasPrefix(line, ".") {
-			fmt.Fprintf(p.conn, ".%s\r\n", line)
+			fmt.Fprintf(p.writer, ".%s\r\n", line)
 		} else {
-			fmt.Fprintf(p.conn, "%s\r\n", line)
+			fmt.Fprintf(p.writer, "%s\r\n", line)
+		}
+	}
+	fmt.Fprint(p.writer, ".\r\n")
+}
+
+// MultiLineReader copies lines from reader as multi-line response. Lines are terminated
+// by CRLF and dot-stuffed on the fly, so the whole message is never held in memory.
+func (p Printer) MultiLineReader(r io.Reader) error {
+	reader := bufio.NewReader(r)
+	lineStart := true
+	for {
+		// long lines are read in parts when buffer is full
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull && chunk[len(chunk)-1] == '\r' {
+			// CR might be followed by LF in the next part
+			chunk = chunk[:len(chunk)-1]
+			reader.UnreadByte()
+		}
+		if len(chunk) > 0 {
+			if lineStart && chunk[0] == '.' {
+				p.writer.WriteByte('.')
+			}
+			lineStart = chunk[len(chunk)-1] == '\n'
+			if lineStart {
+				chunk = bytes.TrimSuffix(chunk[:len(chunk)-1], []byte("\r"))
+			}
+			p.writer.Write(chunk)
+			if lineStart {
+				p.writer.WriteString("\r\n")
+			}
+		}
+		if err == io.EOF {
+			break
 		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if !lineStart {
+		p.writer.WriteString("\r\n")
 	}
-	fmt.Fprint(p.conn, ".\r\n")
+	p.writer.WriteString(".\r\n")
+	return nil
 }
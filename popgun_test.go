@@ -2,10 +2,25 @@ package popgun
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -58,6 +73,319 @@ func TestClient_handle(t *testing.T) {
 	}
 }
 
+// testCertificate generates self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}
+}
+
+// readMultiLine reads multi-line response including termination octet
+func readMultiLine(t *testing.T, reader *bufio.Reader) string {
+	response := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		response += line
+		if line == ".\r\n" {
+			return response
+		}
+	}
+}
+
+type sessionStep struct {
+	input    string
+	expected string
+}
+
+// sessionTest runs client session over pipe. In each step, input line is sent
+// to the server (unless empty) and single response line is matched against
+// expected regular expression.
+func sessionTest(t *testing.T, client *Client, steps []sessionStep) {
+	s, c := net.Pipe()
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		client.handle(s)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(c)
+	//read welcome message
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	sessionSteps(t, c, reader, steps)
+	c.Close()
+	<-done
+}
+
+// sessionSteps runs steps of sessionTest over connection to the server
+func sessionSteps(t *testing.T, conn net.Conn, reader *bufio.Reader, steps []sessionStep) {
+	t.Helper()
+	for _, step := range steps {
+		if step.input != "" {
+			fmt.Fprintf(conn, "%s\r\n", step.input)
+		}
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected to match '%s', but got error: %v", step.expected, err)
+		}
+		matched, err := regexp.MatchString(step.expected, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !matched {
+			t.Errorf("Input '%s': expected to match '%s', but got '%s'", step.input, step.expected, response)
+		}
+	}
+}
+
+func TestClient_handleStls(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+
+	backend := backends.DummyBackend{}
+	authorizator := backends.DummyAuthorizator{}
+	client := newClient(authorizator, backend)
+	client.tlsConfig = &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+
+	go func() {
+		client.handle(s)
+	}()
+
+	reader := bufio.NewReader(c)
+	//read welcome message
+	_, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "+OK Begin TLS negotiation\r\n"
+	fmt.Fprintf(c, "STLS\r\n")
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != expected {
+		t.Fatalf("Expected '%s', but got '%s'", expected, response)
+	}
+
+	tlsConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	reader = bufio.NewReader(tlsConn)
+
+	//STLS is not advertised nor permitted once TLS is active
+	expected = "+OK \r\nSASL LOGIN PLAIN\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nIMPLEMENTATION POPgun\r\nTOP\r\nUIDL\r\nUSER\r\n.\r\n"
+	fmt.Fprintf(tlsConn, "CAPA\r\n")
+	response = readMultiLine(t, reader)
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+
+	expected = "-ERR Command not permitted when TLS active\r\n"
+	fmt.Fprintf(tlsConn, "STLS\r\n")
+	response, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+
+	expected = "+OK Goodbye\r\n"
+	fmt.Fprintf(tlsConn, "QUIT\r\n")
+	response, err = reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+}
+
+func TestNewClient_apop(t *testing.T) {
+	client := newClient(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	if _, ok := client.commands["APOP"]; ok {
+		t.Error("APOP enabled for authorizator without secrets")
+	}
+	if client.timestamp != "" {
+		t.Errorf("Expected no timestamp, but got '%s'", client.timestamp)
+	}
+
+	client = newClient(secretAuthorizator{}, backends.DummyBackend{})
+	if _, ok := client.commands["APOP"]; !ok {
+		t.Error("APOP not enabled for authorizator with secrets")
+	}
+	matched, err := regexp.MatchString("^<[0-9]+\\.[0-9]+\\.[0-9]+@[^>]+>$", client.timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matched {
+		t.Errorf("Invalid timestamp '%s'", client.timestamp)
+	}
+	other := newClient(secretAuthorizator{}, backends.DummyBackend{})
+	if other.timestamp == client.timestamp {
+		t.Errorf("Expected unique timestamps, but got '%s' twice", client.timestamp)
+	}
+}
+
+// failingBackend fails to retrieve messages
+type failingBackend struct {
+	backends.DummyBackend
+}
+
+func (b failingBackend) Retr(user string, msgId int) (string, error) {
+	return "", fmt.Errorf("storage is not available: %w", ErrTemporary)
+}
+
+func TestClient_handleResponseCode(t *testing.T) {
+	sessionTest(t, newClient(backends.DummyAuthorizator{}, failingBackend{}), []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"RETR 1", "^-ERR \\[SYS/TEMP\\] Error executing command RETR\r\n$"},
+		{"DELE a", "^-ERR Invalid argument: a\r\n$"},
+		{"NOOP", "^\\+OK"},
+	})
+}
+
+// writeCountingConn counts writes to the underlying connection
+type writeCountingConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *writeCountingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func TestClient_handlePipelining(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+
+	conn := &writeCountingConn{Conn: s}
+	client := newClient(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	done := make(chan struct{})
+	go func() {
+		client.handle(conn)
+		close(done)
+	}()
+
+	reader := bufio.NewReader(c)
+	if _, err := reader.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := "USER john\r\nPASS secret\r\n"
+	for i := 0; i < 50; i++ {
+		commands += "NOOP\r\n"
+	}
+	go fmt.Fprint(c, commands+"STAT\r\n")
+
+	for i := 0; i < 52; i++ {
+		response, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !regexp.MustCompile("^\\+OK").MatchString(response) {
+			t.Errorf("Expected response %d to be successful, but got '%s'", i, response)
+		}
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != "+OK 5 50\r\n" {
+		t.Errorf("Expected STAT response, but got '%s'", response)
+	}
+	c.Close()
+	<-done
+
+	// welcome message and at least one flush of pipelined responses, but far
+	// less than one write per command
+	if conn.writes < 2 || conn.writes > 10 {
+		t.Errorf("Expected responses to be written in batches, but got %d writes", conn.writes)
+	}
+}
+
+func TestClient_handlePipeliningErrors(t *testing.T) {
+	s, c := net.Pipe()
+	defer c.Close()
+
+	client := newClient(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	go client.handle(s)
+
+	// each command gets exactly one response, even if it's invalid
+	go fmt.Fprint(c, "USER john\r\nPASS secret\r\nLIST 0\r\nTOP 1\r\nRETR a\r\nDELE\r\n"+
+		"UIDL x\r\nTOP 1 x\r\nNOOP\r\nQUIT\r\n")
+	buf, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"+OK POPgun POP3 server ready",
+		"+OK ",
+		"+OK User Successfully Logged on",
+		"-ERR Invalid argument: 0",
+		"-ERR Invalid arguments count for TOP command",
+		"-ERR Invalid argument: a",
+		"-ERR Missing argument for DELE command",
+		"-ERR Invalid argument: x",
+		"-ERR Invalid argument: x",
+		"+OK ",
+		"+OK Goodbye",
+	}
+	responses := strings.Split(strings.TrimSuffix(string(buf), "\r\n"), "\r\n")
+	if !reflect.DeepEqual(responses, expected) {
+		t.Errorf("Expected responses %q, but got %q", expected, responses)
+	}
+}
+
+func TestResponseCode(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+	}{
+		{ErrMailboxInUse, "IN-USE"},
+		{fmt.Errorf("wrapped: %w", ErrPermanent), "SYS/PERM"},
+		{NewResponseError("X-CUSTOM", "custom"), "X-CUSTOM"},
+		{ErrAuthenticationFailed, "AUTH"},
+		{ErrInvalidState, ""},
+		{nil, ""},
+	}
+	for _, testCase := range testCases {
+		if code := responseCode(testCase.err); code != testCase.expected {
+			t.Errorf("Expected code '%s' for '%v', but got '%s'", testCase.expected, testCase.err, code)
+		}
+	}
+}
+
 func TestClient_parseInput(t *testing.T) {
 	backend := backends.DummyBackend{}
 	authorizator := backends.DummyAuthorizator{}
@@ -93,6 +421,7 @@ func TestServer_Start(t *testing.T) {
 	authorizator := backends.DummyAuthorizator{}
 	server := NewServer(cfg, authorizator, backend)
 	server.Start()
+	defer server.Shutdown(context.Background())
 
 	conn, err := net.DialTimeout("tcp", cfg.ListenInterface, 3*time.Second)
 	if err != nil {
@@ -102,14 +431,578 @@ func TestServer_Start(t *testing.T) {
 	defer conn.Close()
 }
 
-type printerFunc func(conn net.Conn)
+// blockingBackend blocks in Retr until released or session context is cancelled
+type blockingBackend struct {
+	BackendV2
+	started  chan struct{}
+	release  chan struct{}
+	unlocked chan string
+}
+
+func newBlockingBackend() blockingBackend {
+	return blockingBackend{
+		BackendV2: AdaptBackend(backends.DummyBackend{}),
+		started:   make(chan struct{}, 1),
+		release:   make(chan struct{}),
+		unlocked:  make(chan string, 10),
+	}
+}
+
+func (b blockingBackend) Retr(ctx context.Context, user string, msgId int) (string, error) {
+	b.started <- struct{}{}
+	select {
+	case <-b.release:
+		return "released", nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (b blockingBackend) Unlock(ctx context.Context, user string) error {
+	b.unlocked <- user
+	return nil
+}
+
+// startShutdownTest starts server and connects logged in client
+func startShutdownTest(t *testing.T, backend BackendV2) (*Server, net.Conn, *bufio.Reader) {
+	server := NewServerV2(Config{}, AdaptAuthorizator(backends.DummyAuthorizator{}), backend)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	fmt.Fprint(conn, "USER john\r\nPASS secret\r\n")
+	for i := 0; i < 3; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, conn, reader
+}
+
+func TestClient_handleMemoryBackend(t *testing.T) {
+	backend := backends.NewMemoryBackend()
+	backend.Add("john", "Subject: first\n\nbody\n")
+	backend.Add("john", "Subject: second\n\nbody\n")
+	client := newClient(backends.DummyAuthorizator{}, backend)
+	sessionTest(t, client, []sessionStep{
+		{"USER john", "^\\+OK"},
+		{"PASS secret", "^\\+OK"},
+		{"STAT", "^\\+OK 2 49\r\n$"},
+		{"DELE 1", "^\\+OK"},
+		{"QUIT", "^\\+OK"},
+	})
+	if messages := backend.Messages("john"); len(messages) != 1 || !strings.Contains(messages[0], "second") {
+		t.Errorf("Expected first message to be deleted, but got %q", messages)
+	}
+}
+
+func TestBackends_ErrMailboxInUse(t *testing.T) {
+	backend := backends.NewMemoryBackend()
+	backend.Lock("john")
+	err := backend.Lock("john")
+	if !errors.Is(err, ErrMailboxInUse) {
+		t.Errorf("Expected error of backends to match ErrMailboxInUse, but got %v", err)
+	}
+	if errors.Is(err, NewResponseError("IN-USE", "other")) || errors.Is(err, ErrAuthenticationFailed) {
+		t.Error("Expected errors with different code or message not to match")
+	}
+}
+
+func TestServer_ShutdownIdle(t *testing.T) {
+	backend := newBlockingBackend()
+	server, conn, reader := startShutdownTest(t, backend)
+	defer conn.Close()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "-ERR [SYS/TEMP] server shutting down\r\n"; response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+	select {
+	case user := <-backend.unlocked:
+		if user != "john" {
+			t.Errorf("Expected maildrop of john to be unlocked, but got %s", user)
+		}
+	default:
+		t.Error("Expected maildrop to be unlocked before Shutdown returned")
+	}
+	if _, err := net.DialTimeout("tcp", conn.RemoteAddr().String(), time.Second); err == nil {
+		t.Error("Expected listener to be closed")
+	}
+}
+
+func TestServer_ShutdownAuth(t *testing.T) {
+	server := NewServer(Config{}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), 3*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sessionSteps(t, conn, reader, []sessionStep{
+		{"", "^\\+OK"},
+		{"AUTH PLAIN", "^\\+ \r\n$"},
+	})
+
+	// waiting for SASL response, single response is sent to AUTH
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "-ERR [SYS/TEMP] server shutting down\r\n"; string(response) != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+}
+
+func TestServer_ShutdownActive(t *testing.T) {
+	backend := newBlockingBackend()
+	server, conn, reader := startShutdownTest(t, backend)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "RETR 1\r\n")
+	<-backend.started
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Expected Shutdown to wait for active command, but it returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	expected := "+OK \r\nreleased\r\n.\r\n-ERR [SYS/TEMP] server shutting down\r\n"
+	response := ""
+	for i := 0; i < 4; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		response += line
+	}
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+	if err := <-shutdown; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServer_ShutdownTimeout(t *testing.T) {
+	backend := newBlockingBackend()
+	server, conn, reader := startShutdownTest(t, backend)
+	defer conn.Close()
+
+	fmt.Fprint(conn, "RETR 1\r\n")
+	<-backend.started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline to be exceeded, but got %v", err)
+	}
+	// connection is closed and blocked backend call is cancelled
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Error("Expected connection to be closed")
+	}
+	select {
+	case <-backend.unlocked:
+	case <-time.After(3 * time.Second):
+		t.Error("Expected maildrop to be unlocked after session context was cancelled")
+	}
+}
+
+// pipeListener is an in-memory listener accepting connections created by dial
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) dial() net.Conn {
+	s, c := net.Pipe()
+	l.conns <- s
+	return c
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "unix"}
+}
+
+func TestServer_Serve(t *testing.T) {
+	server := NewServer(Config{}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	listener := newPipeListener()
+	served := make(chan error)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	conn := listener.dial()
+	reader := bufio.NewReader(conn)
+	if response, err := reader.ReadString('\n'); err != nil || response != "+OK POPgun POP3 server ready\r\n" {
+		t.Errorf("Expected welcome message, but got '%s', %v", response, err)
+	}
+	go func() {
+		// idle client is notified during shutdown
+		reader.ReadString('\n')
+		conn.Close()
+	}()
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, but got %v", err)
+	}
+	if err := server.Serve(newPipeListener()); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed after shutdown, but got %v", err)
+	}
+}
+
+func TestServer_ServeListener(t *testing.T) {
+	cfg := Config{
+		TLSConfig:            &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		DisablePlaintextAuth: true,
+	}
+	tests := []struct {
+		listener ListenerConfig
+		welcome  string
+		user     string
+	}{
+		{ListenerConfig{}, "+OK POPgun POP3 server ready\r\n", "-ERR [AUTH]"},
+		{ListenerConfig{Banner: "internal POP3"}, "+OK internal POP3\r\n", "-ERR [AUTH]"},
+		{ListenerConfig{AuthPolicy: AuthPolicyPlaintext}, "+OK POPgun POP3 server ready\r\n", "+OK"},
+		{ListenerConfig{TLSMode: TLSModeNone, AuthPolicy: AuthPolicyPlaintext}, "+OK POPgun POP3 server ready\r\n", "+OK"},
+	}
+	for _, test := range tests {
+		server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+		listener := newPipeListener()
+		served := make(chan error)
+		go func() {
+			served <- server.ServeListener(listener, test.listener)
+		}()
+
+		conn := listener.dial()
+		reader := bufio.NewReader(conn)
+		if response, err := reader.ReadString('\n'); err != nil || response != test.welcome {
+			t.Errorf("Expected welcome '%s', but got '%s', %v", test.welcome, response, err)
+		}
+		fmt.Fprintf(conn, "USER john\r\n")
+		if response, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(response, test.user) {
+			t.Errorf("Expected USER response '%s' for %+v, but got '%s', %v", test.user, test.listener, response, err)
+		}
+		fmt.Fprintf(conn, "QUIT\r\n")
+		reader.ReadString('\n')
+		conn.Close()
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-served
+	}
+}
+
+func TestServer_ServeListenerInvalid(t *testing.T) {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	tests := []struct {
+		cfg      Config
+		listener ListenerConfig
+	}{
+		{Config{}, ListenerConfig{TLSMode: TLSModeImplicit}},
+		{Config{}, ListenerConfig{AuthPolicy: AuthPolicyTLSRequired}},
+		{Config{}, ListenerConfig{TLSMode: "starttls"}},
+		{Config{}, ListenerConfig{AuthPolicy: "never"}},
+		// default policy refuses plaintext auth, but there is no TLS to upgrade to
+		{Config{DisablePlaintextAuth: true}, ListenerConfig{}},
+		{Config{DisablePlaintextAuth: true, TLSConfig: tlsConfig}, ListenerConfig{TLSMode: TLSModeNone}},
+	}
+	for _, test := range tests {
+		server := NewServer(test.cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+		if err := server.ServeListener(newPipeListener(), test.listener); err == nil || err == ErrServerClosed {
+			t.Errorf("Expected configuration error for %+v, but got %v", test.listener, err)
+		}
+	}
+}
+
+func TestConfig_listenerConfigs(t *testing.T) {
+	internal := ListenerConfig{Address: "10.0.0.1:1100", TLSMode: TLSModeNone, AuthPolicy: AuthPolicyPlaintext}
+	tests := []struct {
+		cfg      Config
+		expected []ListenerConfig
+	}{
+		{Config{}, []ListenerConfig{{}}},
+		{Config{ListenInterface: ":110"}, []ListenerConfig{{Address: ":110"}}},
+		{Config{TLSListenInterface: ":995"}, []ListenerConfig{{Address: ":995", TLSMode: TLSModeImplicit}}},
+		{Config{Listeners: []ListenerConfig{internal}}, []ListenerConfig{internal}},
+		{
+			Config{ListenInterface: ":110", TLSListenInterface: ":995", Listeners: []ListenerConfig{internal}},
+			[]ListenerConfig{{Address: ":110"}, {Address: ":995", TLSMode: TLSModeImplicit}, internal},
+		},
+	}
+	for _, test := range tests {
+		if configs := test.cfg.listenerConfigs(); !reflect.DeepEqual(configs, test.expected) {
+			t.Errorf("Expected listeners %+v, but got %+v", test.expected, configs)
+		}
+	}
+}
+
+func TestServer_ListenAndServeListeners(t *testing.T) {
+	// find free ports
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		l.Close()
+	}
+	cfg := Config{
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}},
+		Listeners: []ListenerConfig{
+			{Address: addrs[0], AuthPolicy: AuthPolicyTLSRequired},
+			{Address: addrs[1], TLSMode: TLSModeImplicit, Banner: "POP3S ready"},
+		},
+	}
+	server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	served := make(chan error)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addrs[0]); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Expected listening on '%s', but could not connect: %v", addrs[0], err)
+	}
+	reader := bufio.NewReader(conn)
+	reader.ReadString('\n')
+	fmt.Fprintf(conn, "USER john\r\n")
+	if response, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(response, "-ERR [AUTH]") {
+		t.Errorf("Expected plaintext auth to be refused, but got '%s', %v", response, err)
+	}
+	conn.Close()
+
+	tlsConn, err := tls.Dial("tcp", addrs[1], &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected implicit TLS on '%s', but got %v", addrs[1], err)
+	}
+	if response, err := bufio.NewReader(tlsConn).ReadString('\n'); err != nil || response != "+OK POP3S ready\r\n" {
+		t.Errorf("Expected listener banner, but got '%s', %v", response, err)
+	}
+	tlsConn.Close()
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, but got %v", err)
+	}
+}
+
+func TestServer_ListenAndServe(t *testing.T) {
+	// find free port
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{ListenInterface: l.Addr().String()}
+	l.Close()
+
+	server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	served := make(chan error)
+	go func() {
+		served <- server.ListenAndServe()
+	}()
+
+	var conn net.Conn
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", cfg.ListenInterface); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Expected listening on '%s', but could not connect: %v", cfg.ListenInterface, err)
+	}
+	conn.Close()
+
+	select {
+	case err := <-served:
+		t.Fatalf("Expected ListenAndServe to block, but it returned %v", err)
+	default:
+	}
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, but got %v", err)
+	}
+}
+
+// writeTestCertificate stores self-signed certificate and its key in PEM files
+func writeTestCertificate(t *testing.T) (certFile, keyFile string) {
+	cert := testCertificate(t)
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestServer_StartTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	cfg := Config{
+		TLSListenInterface: "localhost:3002",
+		TLSCertFile:        certFile,
+		TLSKeyFile:         keyFile,
+	}
+	backend := backends.DummyBackend{}
+	authorizator := backends.DummyAuthorizator{}
+	server := NewServer(cfg, authorizator, backend)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown(context.Background())
+
+	dialer := &net.Dialer{Timeout: 3 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", cfg.TLSListenInterface, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected TLS listening on '%s', but could not connect: %v", cfg.TLSListenInterface, err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	expected := "+OK POPgun POP3 server ready\r\n"
+	response, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+
+	//STLS is not advertised on implicit TLS connection
+	expected = "+OK \r\nSASL LOGIN PLAIN\r\nRESP-CODES\r\nAUTH-RESP-CODE\r\nPIPELINING\r\nIMPLEMENTATION POPgun\r\nTOP\r\nUIDL\r\nUSER\r\n.\r\n"
+	fmt.Fprintf(conn, "CAPA\r\n")
+	response = readMultiLine(t, reader)
+	if response != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, response)
+	}
+}
+
+func TestServer_StartTLSWithoutCertificate(t *testing.T) {
+	cfg := Config{
+		TLSListenInterface: "localhost:3003",
+	}
+	server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	if err := server.Start(); err == nil {
+		t.Error("Expected error when TLS is not configured, but got none")
+	}
+
+	cfg.TLSCertFile = "missing.pem"
+	cfg.TLSKeyFile = "missing.pem"
+	server = NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	if err := server.Start(); err == nil {
+		t.Error("Expected error when certificate cannot be loaded, but got none")
+	}
+}
+
+func TestServer_configureClient(t *testing.T) {
+	cfg := Config{
+		DisablePlaintextAuth: true,
+		Expire:               "NEVER",
+		LoginDelay:           60,
+		UTF8:                 true,
+		TokenVerifier:        tokenVerifier{},
+		ZeroBasedMessageIds:  true,
+	}
+	server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.RegisterCommand("xcustom", capabilityCommand{})
+
+	c := newClient(backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.configureClient(c)
+	if !c.disablePlaintextAuth || c.expire != "NEVER" || c.loginDelay != 60 || !c.zeroBasedMessageIds {
+		t.Errorf("Configuration not applied to client: %v, '%s', %d, %v",
+			c.disablePlaintextAuth, c.expire, c.loginDelay, c.zeroBasedMessageIds)
+	}
+	for _, name := range []string{"UTF8", "XCUSTOM"} {
+		if _, ok := c.commands[name]; !ok {
+			t.Errorf("Expected command %s to be registered", name)
+		}
+	}
+	for _, name := range []string{"XOAUTH2", "OAUTHBEARER"} {
+		if _, ok := c.saslMechanisms[name]; !ok {
+			t.Errorf("Expected SASL mechanism %s to be registered", name)
+		}
+	}
+}
+
+type printerFunc func(p *Printer)
 
 func printerTest(t *testing.T, f printerFunc) string {
 	s, c := net.Pipe()
 	defer s.Close()
 
 	go func() {
-		f(c)
+		p := NewPrinter(c)
+		f(p)
+		p.Flush()
 		c.Close()
 	}()
 
@@ -123,8 +1016,7 @@ func printerTest(t *testing.T, f printerFunc) string {
 func TestPrinter_Welcome(t *testing.T) {
 	expected := "+OK POPgun POP3 server ready\r\n"
 
-	msg := printerTest(t, func(conn net.Conn) {
-		p := NewPrinter(conn)
+	msg := printerTest(t, func(p *Printer) {
 		p.Welcome()
 	})
 
@@ -133,11 +1025,22 @@ func TestPrinter_Welcome(t *testing.T) {
 	}
 }
 
+func TestPrinter_WelcomeWithTimestamp(t *testing.T) {
+	expected := "+OK POPgun POP3 server ready <1896.697170952@dbc.mtview.ca.us>\r\n"
+
+	msg := printerTest(t, func(p *Printer) {
+		p.WelcomeWithTimestamp("<1896.697170952@dbc.mtview.ca.us>")
+	})
+
+	if msg != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, msg)
+	}
+}
+
 func TestPrinter_Ok(t *testing.T) {
 	expected := "+OK 2 foxes jumping over lazy dog\r\n"
 
-	msg := printerTest(t, func(conn net.Conn) {
-		p := NewPrinter(conn)
+	msg := printerTest(t, func(p *Printer) {
 		p.Ok("%d foxes jumping over lazy dog", 2)
 	})
 
@@ -149,8 +1052,7 @@ func TestPrinter_Ok(t *testing.T) {
 func TestPrinter_Err(t *testing.T) {
 	expected := "-ERR everything wrong in 10 seconds\r\n"
 
-	msg := printerTest(t, func(conn net.Conn) {
-		p := NewPrinter(conn)
+	msg := printerTest(t, func(p *Printer) {
 		p.Err("everything wrong in %d seconds", 10)
 	})
 
@@ -159,11 +1061,35 @@ func TestPrinter_Err(t *testing.T) {
 	}
 }
 
+func TestPrinter_ErrCode(t *testing.T) {
+	expected := "-ERR [SYS/TEMP] try again in 10 seconds\r\n-ERR no code\r\n"
+
+	msg := printerTest(t, func(p *Printer) {
+		p.ErrCode("SYS/TEMP", "try again in %d seconds", 10)
+		p.ErrCode("", "no code")
+	})
+
+	if msg != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, msg)
+	}
+}
+
+func TestPrinter_Continue(t *testing.T) {
+	expected := "+ VXNlcm5hbWU6\r\n"
+
+	msg := printerTest(t, func(p *Printer) {
+		p.Continue("VXNlcm5hbWU6")
+	})
+
+	if msg != expected {
+		t.Errorf("Expected '%s', but got '%s'", expected, msg)
+	}
+}
+
 func TestPrinter_MultiLine(t *testing.T) {
 	expected := "multi\r\nline\r\n.\r\n"
 
-	msg := printerTest(t, func(conn net.Conn) {
-		p := NewPrinter(conn)
+	msg := printerTest(t, func(p *Printer) {
 		p.MultiLine([]string{"multi", "line"})
 	})
 
@@ -171,3 +1097,29 @@ func TestPrinter_MultiLine(t *testing.T) {
 		t.Errorf("Expected '%s', but got '%s'", expected, msg)
 	}
 }
+
+func TestPrinter_MultiLineReader(t *testing.T) {
+	longLine := strings.Repeat("x", 4095) + "\r\n" + strings.Repeat("y", 5000)
+	testCases := []struct {
+		message  string
+		expected string
+	}{
+		{"", ".\r\n"},
+		{"single line", "single line\r\n.\r\n"},
+		{"unix\nline\nendings\n", "unix\r\nline\r\nendings\r\n.\r\n"},
+		{"Subject: dots\r\n\r\n.\r\n..two\r\nnot. first", "Subject: dots\r\n\r\n..\r\n...two\r\nnot. first\r\n.\r\n"},
+		{longLine, longLine + "\r\n.\r\n"},
+		{strings.Repeat(".", 5000), "." + strings.Repeat(".", 5000) + "\r\n.\r\n"},
+	}
+	for _, testCase := range testCases {
+		msg := printerTest(t, func(p *Printer) {
+			if err := p.MultiLineReader(strings.NewReader(testCase.message)); err != nil {
+				t.Error(err)
+			}
+		})
+		if msg != testCase.expected {
+			t.Errorf("Expected '%.50s' (%d bytes), but got '%.50s' (%d bytes)",
+				testCase.expected, len(testCase.expected), msg, len(msg))
+		}
+	}
+}
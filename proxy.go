@@ -0,0 +1,205 @@
+package popgun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout limits time to receive PROXY protocol header
+var proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts PROXY protocol version 2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is maximum length of PROXY protocol version 1 header including CRLF
+const proxyV1MaxLength = 107
+
+// proxyConn is a connection received through a proxy, which reports addresses
+// sent in PROXY protocol header
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// parseTrustedProxies parses CIDR list of trusted proxies, single addresses are accepted as well
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			addr, err := netip.ParseAddr(proxy)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", proxy, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// trustedProxy returns whether connection comes from one of trusted proxies
+func trustedProxy(conn net.Conn, trusted []netip.Prefix) bool {
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	addr := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxy reads PROXY protocol header (version 1 or 2) of connection received from trusted proxy
+// and returns connection reporting addresses of the client. Connections from other sources are
+// returned unchanged.
+func acceptProxy(conn net.Conn, trusted []netip.Prefix) (net.Conn, error) {
+	if !trustedProxy(conn, trusted) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	remoteAddr, localAddr, err := readProxyHeader(conn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+	}
+	if remoteAddr == nil {
+		// health check of the proxy or unknown protocol, addresses of connection are used
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remoteAddr: remoteAddr, localAddr: localAddr}, nil
+}
+
+// readProxyHeader reads PROXY protocol header without reading any data following it.
+// Nil addresses are returned for LOCAL command (v2) or UNKNOWN protocol (v1).
+func readProxyHeader(r io.Reader) (remoteAddr, localAddr net.Addr, err error) {
+	// both versions are at least 12 bytes long
+	header := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(header, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if bytes.HasPrefix(header, []byte("PROXY ")) {
+		return readProxyV1(r, header)
+	}
+	return nil, nil, errors.New("missing PROXY protocol signature")
+}
+
+// readProxyV1 reads the rest of human-readable header, e.g. "PROXY TCP4 192.0.2.1 192.0.2.2 56324 110\r\n"
+func readProxyV1(r io.Reader, header []byte) (net.Addr, net.Addr, error) {
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) >= proxyV1MaxLength {
+			return nil, nil, errors.New("header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		header = append(header, b[0])
+	}
+	fields := strings.Split(string(header[:len(header)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed header %q", header)
+	}
+	remoteAddr, err := parseProxyV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	localAddr, err := parseProxyV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return remoteAddr, localAddr, nil
+}
+
+func parseProxyV1Addr(protocol, ip, port string) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != (protocol == "TCP4") {
+		return nil, fmt.Errorf("invalid %s address %q", protocol, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readProxyV2 reads the rest of binary header following the signature
+func readProxyV2(r io.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	version, command := header[0]>>4, header[0]&0x0f
+	family, protocol := header[1]>>4, header[1]&0x0f
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if version != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", version)
+	}
+	switch command {
+	case 0x0:
+		// LOCAL command, e.g. health check of the proxy
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", command)
+	}
+	if protocol != 0x1 {
+		// only TCP connections are proxied to POP3 server
+		return nil, nil, nil
+	}
+
+	var size int
+	switch family {
+	case 0x1:
+		size = net.IPv4len
+	case 0x2:
+		size = net.IPv6len
+	default:
+		// AF_UNSPEC or AF_UNIX
+		return nil, nil, nil
+	}
+	// source and destination address followed by source and destination port,
+	// TLVs after addresses are ignored
+	if len(payload) < 2*size+4 {
+		return nil, nil, errors.New("address block too short")
+	}
+	remoteIP, _ := netip.AddrFromSlice(payload[:size])
+	localIP, _ := netip.AddrFromSlice(payload[size : 2*size])
+	remotePort := binary.BigEndian.Uint16(payload[2*size:])
+	localPort := binary.BigEndian.Uint16(payload[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(remoteIP, remotePort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(localIP, localPort)), nil
+}
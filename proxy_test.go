@@ -0,0 +1,225 @@
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// proxyV2Header builds binary PROXY protocol header of TCP connection
+func proxyV2Header(command byte, remote, local *net.TCPAddr, tlvs []byte) string {
+	family := byte(0x11)
+	remoteIP, localIP := []byte(remote.IP.To4()), []byte(local.IP.To4())
+	if remoteIP == nil {
+		family = 0x21
+		remoteIP, localIP = remote.IP.To16(), local.IP.To16()
+	}
+	payload := append(append([]byte{}, remoteIP...), localIP...)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(remote.Port))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(local.Port))
+	payload = append(payload, tlvs...)
+
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	remote4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 40000}
+	local4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 110}
+	remote6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	local6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 995}
+	tests := []struct {
+		header string
+		remote string
+		local  string
+		err    bool
+	}{
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 40000 110\r\n", "203.0.113.7:40000", "192.0.2.1:110", false},
+		{"PROXY TCP6 2001:db8::7 2001:db8::1 40000 995\r\n", "[2001:db8::7]:40000", "[2001:db8::1]:995", false},
+		{"PROXY UNKNOWN\r\n", "", "", false},
+		{"PROXY UNKNOWN 2001:db8::7 2001:db8::1 40000 995\r\n", "", "", false},
+		{"PROXY TCP4 2001:db8::7 192.0.2.1 40000 110\r\n", "", "", true},
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 70000 110\r\n", "", "", true},
+		{"PROXY TCP4 203.0.113.7 192.0.2.1 40000\r\n", "", "", true},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", "", true},
+		{"USER john\r\nPASS secret\r\n", "", "", true},
+		{proxyV2Header(0x1, remote4, local4, nil), "203.0.113.7:40000", "192.0.2.1:110", false},
+		{proxyV2Header(0x1, remote6, local6, []byte{0x04, 0x00, 0x01, 0x00}), "[2001:db8::7]:40000", "[2001:db8::1]:995", false},
+		{proxyV2Header(0x0, remote4, local4, nil), "", "", false},
+		{proxyV2Header(0x2, remote4, local4, nil), "", "", true},
+		{proxyV2Header(0x1, remote4, local4, nil)[:20], "", "", true},
+	}
+	for _, test := range tests {
+		r := strings.NewReader(test.header + "CAPA\r\n")
+		remote, local, err := readProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("Expected error for header %q", test.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for header %q: %v", test.header, err)
+			continue
+		}
+		if fmt.Sprint(remote) != fmt.Sprint(addrOrNil(test.remote)) || fmt.Sprint(local) != fmt.Sprint(addrOrNil(test.local)) {
+			t.Errorf("Expected addresses %s, %s for header %q, but got %v, %v", test.remote, test.local, test.header, remote, local)
+		}
+		// data following the header are left for the client
+		if rest, _ := io.ReadAll(r); string(rest) != "CAPA\r\n" {
+			t.Errorf("Expected data following header to be kept, but got %q", rest)
+		}
+	}
+}
+
+func addrOrNil(addr string) net.Addr {
+	if addr == "" {
+		return nil
+	}
+	tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+	return tcpAddr
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7", "2001:db8::/32", "172.16.1.1/12"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"10.0.0.0/8", "192.0.2.7/32", "2001:db8::/32", "172.16.0.0/12"}
+	for i, prefix := range prefixes {
+		if prefix.String() != expected[i] {
+			t.Errorf("Expected prefix %s, but got %s", expected[i], prefix)
+		}
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "proxy.example.com", ""} {
+		if _, err := parseTrustedProxies([]string{invalid}); err == nil {
+			t.Errorf("Expected error for trusted proxy %q", invalid)
+		}
+	}
+}
+
+// sessionAuthorizator sends session of every authorization to channel
+type sessionAuthorizator chan SessionInfo
+
+func (a sessionAuthorizator) Authorize(ctx context.Context, user, pass string) (bool, error) {
+	session, _ := SessionFromContext(ctx)
+	a <- session
+	return true, nil
+}
+
+func TestServer_ServeListenerProxy(t *testing.T) {
+	tests := []struct {
+		listener ListenerConfig
+		header   string
+		remote   string
+		proxied  bool
+	}{
+		{
+			ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.0/8", "::1"}},
+			"PROXY TCP4 203.0.113.7 192.0.2.1 40000 110\r\n", "203.0.113.7:40000", true,
+		},
+		{
+			ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}, TLSMode: TLSModeImplicit},
+			proxyV2Header(0x1, &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000},
+				&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 995}, nil),
+			"[2001:db8::7]:40000", true,
+		},
+		{
+			ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}},
+			"PROXY UNKNOWN\r\n", "", false,
+		},
+		{
+			// direct connection from untrusted source
+			ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/8"}},
+			"", "", false,
+		},
+	}
+	for _, test := range tests {
+		cfg := Config{TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+		sessions := make(sessionAuthorizator, 1)
+		server := NewServerV2(cfg, sessions, AdaptBackend(backends.DummyBackend{}))
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan error)
+		go func() {
+			served <- server.ServeListener(listener, test.listener)
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprint(conn, test.header)
+		if test.listener.TLSMode == TLSModeImplicit {
+			conn = tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+		reader := bufio.NewReader(conn)
+		if response, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(response, "+OK") {
+			t.Errorf("Expected welcome message, but got '%s', %v", response, err)
+		}
+		fmt.Fprintf(conn, "USER john\r\nPASS secret\r\n")
+		session := <-sessions
+		remote := test.remote
+		if remote == "" {
+			remote = conn.LocalAddr().String()
+		}
+		if session.RemoteAddr.String() != remote {
+			t.Errorf("Expected client address %s, but got %s", remote, session.RemoteAddr)
+		}
+		if test.proxied && (session.ProxyAddr == nil || session.ProxyAddr.String() != conn.LocalAddr().String()) {
+			t.Errorf("Expected proxy address %s, but got %v", conn.LocalAddr(), session.ProxyAddr)
+		} else if !test.proxied && session.ProxyAddr != nil {
+			t.Errorf("Expected no proxy address, but got %s", session.ProxyAddr)
+		}
+		conn.Close()
+		if err := server.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		<-served
+	}
+}
+
+func TestServer_ServeListenerProxyInvalid(t *testing.T) {
+	server := NewServer(Config{}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() {
+		served <- server.ServeListener(listener, ListenerConfig{ProxyProtocol: true, TrustedProxies: []string{"127.0.0.1"}})
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "USER john\r\nPASS secret\r\n")
+	if response, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("Expected connection without PROXY header to be closed, but got '%s'", response)
+	}
+	conn.Close()
+	server.Shutdown(context.Background())
+	<-served
+
+	for _, cfg := range []ListenerConfig{
+		{ProxyProtocol: true},
+		{ProxyProtocol: true, TrustedProxies: []string{"10.0.0.0/33"}},
+	} {
+		if err := server.ServeListener(newPipeListener(), cfg); err == nil || err == ErrServerClosed {
+			t.Errorf("Expected configuration error for %+v, but got %v", cfg, err)
+		}
+	}
+}
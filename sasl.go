@@ -0,0 +1,145 @@
+package popgun
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// SaslMechanism is an authentication mechanism available via AUTH command (RFC 5034)
+type SaslMechanism interface {
+	// Start creates server side of a new authentication exchange for the client
+	Start(c *Client) SaslServer
+	// Plaintext returns true if mechanism transfers passwords in clear text. Such mechanisms
+	// are not available on non-secured connections when Config.DisablePlaintextAuth is set.
+	Plaintext() bool
+}
+
+// SaslServer is a server side of single SASL authentication exchange
+type SaslServer interface {
+	// Next processes client response and returns challenge to be sent to the client.
+	// Response is nil if client didn't send initial response. When done is true,
+	// the client is authenticated and no challenge is sent.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User returns identity of authenticated user
+	User() string
+}
+
+var (
+	// ErrAuthenticationFailed is returned by SaslServer when credentials are not valid
+	ErrAuthenticationFailed = NewResponseError("AUTH", "Authentication failed")
+	// ErrInvalidSaslResponse is returned by SaslServer when client response is malformed
+	ErrInvalidSaslResponse = fmt.Errorf("Invalid authentication data")
+)
+
+// saslMechanismNames returns sorted names of mechanisms available to the client
+func (c *Client) saslMechanismNames() []string {
+	var names []string
+	for name, mech := range c.saslMechanisms {
+		if mech.Plaintext() && !c.plaintextAuthAllowed() {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//---------------PLAIN
+
+// PlainMechanism implements PLAIN mechanism (RFC 4616) using client's Authorizator
+type PlainMechanism struct{}
+
+func (m PlainMechanism) Start(c *Client) SaslServer {
+	return &plainServer{authorize: c.authorize}
+}
+
+func (m PlainMechanism) Plaintext() bool {
+	return true
+}
+
+type plainServer struct {
+	authorize func(user, pass string) (bool, error)
+	user      string
+}
+
+func (s *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	// message = [authzid] NUL authcid NUL passwd
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	authzid, authcid, pass := string(parts[0]), string(parts[1]), string(parts[2])
+	if authzid != "" && authzid != authcid {
+		return nil, false, ErrAuthenticationFailed
+	}
+	ok, err := s.authorize(authcid, pass)
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, ErrAuthenticationFailed
+	}
+	s.user = authcid
+	return nil, true, nil
+}
+
+func (s *plainServer) User() string {
+	return s.user
+}
+
+//---------------LOGIN
+
+// LoginMechanism implements obsolete, but widely used LOGIN mechanism
+// (draft-murchison-sasl-login) using client's Authorizator
+type LoginMechanism struct{}
+
+func (m LoginMechanism) Start(c *Client) SaslServer {
+	return &loginServer{authorize: c.authorize}
+}
+
+func (m LoginMechanism) Plaintext() bool {
+	return true
+}
+
+type loginServer struct {
+	authorize func(user, pass string) (bool, error)
+	user      string
+	step      int
+}
+
+func (s *loginServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		s.step++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+		// initial response contains username
+		s.user = string(response)
+		s.step++
+		return []byte("Password:"), false, nil
+	case 1:
+		s.user = string(response)
+		s.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		s.step++
+		ok, err := s.authorize(s.user, string(response))
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, ErrAuthenticationFailed
+		}
+		return nil, true, nil
+	}
+	return nil, false, ErrInvalidSaslResponse
+}
+
+func (s *loginServer) User() string {
+	return s.user
+}
@@ -0,0 +1,66 @@
+package popgun
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// CramMD5Mechanism implements CRAM-MD5 mechanism (RFC 2195) using SecretAuthorizator
+type CramMD5Mechanism struct{}
+
+func (m CramMD5Mechanism) Start(c *Client) SaslServer {
+	return &cramMD5Server{ctx: c.ctx, authorizator: secretExtension(c.authorizator), challenge: newTimestamp()}
+}
+
+func (m CramMD5Mechanism) Plaintext() bool {
+	return false
+}
+
+type cramMD5Server struct {
+	ctx          context.Context
+	authorizator SecretAuthorizatorV2
+	challenge    string
+	challenged   bool
+	user         string
+}
+
+func (s *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if s.authorizator == nil {
+		return nil, false, ErrAuthenticationFailed
+	}
+	if !s.challenged {
+		// initial response is not allowed in CRAM-MD5
+		if response != nil {
+			return nil, false, ErrInvalidSaslResponse
+		}
+		s.challenged = true
+		return []byte(s.challenge), false, nil
+	}
+
+	// response = user SP digest
+	i := strings.LastIndex(string(response), " ")
+	if i < 0 {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	user, digest := string(response[:i]), strings.ToLower(string(response[i+1:]))
+	exists, secret, err := s.authorizator.Secret(s.ctx, user)
+	if err != nil {
+		return nil, false, err
+	}
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write([]byte(s.challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !exists || subtle.ConstantTimeCompare([]byte(digest), []byte(expected)) != 1 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	s.user = user
+	return nil, true, nil
+}
+
+func (s *cramMD5Server) User() string {
+	return s.user
+}
@@ -0,0 +1,50 @@
+package popgun
+
+import (
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+func TestCramMD5Mechanism(t *testing.T) {
+	// example from RFC 2195
+	authorizator := secretAuthorizator{"tim": "tanstaaftanstaaf"}
+	testCases := []struct {
+		response    string
+		expectedErr error
+	}{
+		{"tim b913a602c7eda7a495b4e6e7334d3890", nil},
+		{"tim B913A602C7EDA7A495B4E6E7334D3890", nil},
+		{"tim 00000000000000000000000000000000", ErrAuthenticationFailed},
+		{"joe b913a602c7eda7a495b4e6e7334d3890", ErrAuthenticationFailed},
+		{"tim", ErrInvalidSaslResponse},
+	}
+	for _, testCase := range testCases {
+		client := newClient(authorizator, backends.DummyBackend{})
+		server := client.saslMechanisms["CRAM-MD5"].Start(client)
+		server.(*cramMD5Server).challenge = "<1896.697170952@postoffice.reston.mci.net>"
+
+		challenge, done, err := server.Next(nil)
+		if err != nil || done {
+			t.Fatalf("Expected challenge, but got %v, %v", done, err)
+		}
+		if string(challenge) != "<1896.697170952@postoffice.reston.mci.net>" {
+			t.Errorf("Unexpected challenge '%s'", challenge)
+		}
+		_, done, err = server.Next([]byte(testCase.response))
+		if err != testCase.expectedErr {
+			t.Errorf("Response '%s': expected error '%v', but got '%v'", testCase.response, testCase.expectedErr, err)
+		}
+		if testCase.expectedErr == nil && (!done || server.User() != "tim") {
+			t.Errorf("Response '%s': expected user 'tim' to be authenticated", testCase.response)
+		}
+	}
+}
+
+func TestCramMD5Mechanism_initialResponse(t *testing.T) {
+	client := newClient(secretAuthorizator{}, backends.DummyBackend{})
+	server := client.saslMechanisms["CRAM-MD5"].Start(client)
+	if _, _, err := server.Next([]byte("tim")); err != ErrInvalidSaslResponse {
+		t.Errorf("Expected error '%v', but got '%v'", ErrInvalidSaslResponse, err)
+	}
+}
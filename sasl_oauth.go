@@ -0,0 +1,174 @@
+package popgun
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// TokenVerifier verifies OAuth 2.0 bearer tokens used by XOAUTH2 and OAUTHBEARER mechanisms,
+// see Config.TokenVerifier
+type TokenVerifier interface {
+	// VerifyToken validates bearer token and returns user the token was issued for.
+	// Any error means that the token is not valid.
+	VerifyToken(token string) (user string, err error)
+}
+
+// oauthError is an error challenge sent when bearer token is not valid (RFC 7628 section 3.2.2)
+type oauthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+// OAuthBearerMechanism implements OAUTHBEARER mechanism (RFC 7628)
+type OAuthBearerMechanism struct {
+	Verifier TokenVerifier
+	// VerifierV2 is used instead of Verifier when set
+	VerifierV2 TokenVerifierV2
+	// Scope is included in error challenge when the token is not valid
+	Scope string
+}
+
+func (m OAuthBearerMechanism) Start(c *Client) SaslServer {
+	return &oauthServer{
+		ctx:      c.ctx,
+		verifier: adaptTokenVerifier(m.VerifierV2, m.Verifier),
+		parse:    parseOAuthBearer,
+		failure:  oauthError{Status: "invalid_token", Schemes: "bearer", Scope: m.Scope},
+	}
+}
+
+// Plaintext returns true, because bearer token is as sensitive as password
+func (m OAuthBearerMechanism) Plaintext() bool {
+	return true
+}
+
+// XOAuth2Mechanism implements XOAUTH2 mechanism used by Google and Microsoft
+type XOAuth2Mechanism struct {
+	Verifier TokenVerifier
+	// VerifierV2 is used instead of Verifier when set
+	VerifierV2 TokenVerifierV2
+	// Scope is included in error challenge when the token is not valid
+	Scope string
+}
+
+func (m XOAuth2Mechanism) Start(c *Client) SaslServer {
+	return &oauthServer{
+		ctx:      c.ctx,
+		verifier: adaptTokenVerifier(m.VerifierV2, m.Verifier),
+		parse:    parseXOAuth2,
+		failure:  oauthError{Status: "401", Schemes: "bearer", Scope: m.Scope},
+	}
+}
+
+// Plaintext returns true, because bearer token is as sensitive as password
+func (m XOAuth2Mechanism) Plaintext() bool {
+	return true
+}
+
+type oauthServer struct {
+	ctx      context.Context
+	verifier TokenVerifierV2
+	// parse returns requested user (which might be empty) and bearer token
+	parse   func(response []byte) (user, token string, err error)
+	failure oauthError
+	step    int
+	user    string
+}
+
+func (s *oauthServer) Next(response []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		s.step++
+		user, token, err := s.parse(response)
+		if err != nil {
+			return nil, false, err
+		}
+		tokenUser, err := s.verifier.VerifyToken(s.ctx, token)
+		if err != nil || tokenUser == "" || (user != "" && user != tokenUser) {
+			// client has to acknowledge error challenge before failure is reported
+			challenge, err := json.Marshal(s.failure)
+			if err != nil {
+				return nil, false, err
+			}
+			return challenge, false, nil
+		}
+		s.user = tokenUser
+		return nil, true, nil
+	case 1:
+		s.step++
+		return nil, false, ErrAuthenticationFailed
+	}
+	return nil, false, ErrInvalidSaslResponse
+}
+
+func (s *oauthServer) User() string {
+	return s.user
+}
+
+// parseOAuthBearer parses client response of OAUTHBEARER:
+// gs2-header kvsep *kvpair kvsep, where kvsep is %x01
+func parseOAuthBearer(response []byte) (user, token string, err error) {
+	parts := bytes.Split(response, []byte{1})
+	if len(parts) < 3 || len(parts[len(parts)-1]) != 0 || len(parts[len(parts)-2]) != 0 {
+		return "", "", ErrInvalidSaslResponse
+	}
+	header := strings.Split(string(parts[0]), ",")
+	if len(header) != 3 || (header[0] != "n" && header[0] != "y") || header[2] != "" {
+		return "", "", ErrInvalidSaslResponse
+	}
+	if header[1] != "" {
+		if !strings.HasPrefix(header[1], "a=") {
+			return "", "", ErrInvalidSaslResponse
+		}
+		var ok bool
+		if user, ok = scramDecodeName(header[1][2:]); !ok {
+			return "", "", ErrInvalidSaslResponse
+		}
+	}
+	token, ok := bearerToken(parts[1 : len(parts)-2])
+	if !ok {
+		return "", "", ErrInvalidSaslResponse
+	}
+	return user, token, nil
+}
+
+// parseXOAuth2 parses client response of XOAUTH2:
+// "user=" user %x01 "auth=Bearer " token %x01 %x01
+func parseXOAuth2(response []byte) (user, token string, err error) {
+	parts := bytes.Split(response, []byte{1})
+	if len(parts) < 3 || len(parts[len(parts)-1]) != 0 || len(parts[len(parts)-2]) != 0 {
+		return "", "", ErrInvalidSaslResponse
+	}
+	pairs := parts[:len(parts)-2]
+	if !bytes.HasPrefix(pairs[0], []byte("user=")) {
+		return "", "", ErrInvalidSaslResponse
+	}
+	user = string(pairs[0][len("user="):])
+	token, ok := bearerToken(pairs[1:])
+	if !ok || user == "" {
+		return "", "", ErrInvalidSaslResponse
+	}
+	return user, token, nil
+}
+
+// bearerToken finds "auth" key in key-value pairs and returns its bearer token
+func bearerToken(pairs [][]byte) (string, bool) {
+	for _, pair := range pairs {
+		key, value, found := strings.Cut(string(pair), "=")
+		if !found || key != "auth" {
+			continue
+		}
+		scheme, token, found := strings.Cut(value, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", false
+		}
+		return token, true
+	}
+	return "", false
+}
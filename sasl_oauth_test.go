@@ -0,0 +1,128 @@
+package popgun
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// tokenVerifier maps tokens to users
+type tokenVerifier map[string]string
+
+func (v tokenVerifier) VerifyToken(token string) (string, error) {
+	user, ok := v[token]
+	if !ok {
+		return "", fmt.Errorf("unknown token")
+	}
+	return user, nil
+}
+
+func TestOAuthBearerMechanism(t *testing.T) {
+	mech := OAuthBearerMechanism{Verifier: tokenVerifier{"vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==": "user@example.com"}}
+	testCases := []struct {
+		response    string
+		done        bool
+		challenge   string
+		expectedErr error
+	}{
+		// example from RFC 7628 section 4.1
+		{"n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01", true, "", nil},
+		{"n,,\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01", true, "", nil},
+		{"n,a=admin@example.com,\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01", false, `{"status":"invalid_token","schemes":"bearer"}`, nil},
+		{"n,,\x01auth=Bearer invalid\x01\x01", false, `{"status":"invalid_token","schemes":"bearer"}`, nil},
+		{"n,,\x01auth=Basic dXNlcjpwYXNz\x01\x01", false, "", ErrInvalidSaslResponse},
+		{"n,,\x01host=server.example.com\x01\x01", false, "", ErrInvalidSaslResponse},
+		{"n,a=user@example.com,auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==", false, "", ErrInvalidSaslResponse},
+	}
+	for _, testCase := range testCases {
+		server := mech.Start(newClient(backends.DummyAuthorizator{}, backends.DummyBackend{}))
+		challenge, done, err := server.Next([]byte(testCase.response))
+		if err != testCase.expectedErr || done != testCase.done || string(challenge) != testCase.challenge {
+			t.Errorf("Response %q: expected %v, '%s', %v, but got %v, '%s', %v", testCase.response,
+				testCase.done, testCase.challenge, testCase.expectedErr, done, challenge, err)
+		}
+		if done && server.User() != "user@example.com" {
+			t.Errorf("Expected user 'user@example.com', but got '%s'", server.User())
+		}
+		if err == nil && !done {
+			//client acknowledges error challenge
+			if _, _, err := server.Next([]byte{1}); err != ErrAuthenticationFailed {
+				t.Errorf("Expected error '%v', but got '%v'", ErrAuthenticationFailed, err)
+			}
+		}
+	}
+}
+
+func TestXOAuth2Mechanism(t *testing.T) {
+	mech := XOAuth2Mechanism{Verifier: tokenVerifier{"ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg": "someuser@example.com"}}
+	testCases := []struct {
+		response    string
+		done        bool
+		challenge   string
+		expectedErr error
+	}{
+		{"user=someuser@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg\x01\x01", true, "", nil},
+		{"user=other@example.com\x01auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg\x01\x01", false, `{"status":"401","schemes":"bearer"}`, nil},
+		{"user=someuser@example.com\x01auth=Bearer invalid\x01\x01", false, `{"status":"401","schemes":"bearer"}`, nil},
+		{"auth=Bearer ya29.vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg\x01\x01", false, "", ErrInvalidSaslResponse},
+		{"user=someuser@example.com\x01\x01", false, "", ErrInvalidSaslResponse},
+	}
+	for _, testCase := range testCases {
+		server := mech.Start(newClient(backends.DummyAuthorizator{}, backends.DummyBackend{}))
+		challenge, done, err := server.Next([]byte(testCase.response))
+		if err != testCase.expectedErr || done != testCase.done || string(challenge) != testCase.challenge {
+			t.Errorf("Response %q: expected %v, '%s', %v, but got %v, '%s', %v", testCase.response,
+				testCase.done, testCase.challenge, testCase.expectedErr, done, challenge, err)
+		}
+		if done && server.User() != "someuser@example.com" {
+			t.Errorf("Expected user 'someuser@example.com', but got '%s'", server.User())
+		}
+	}
+}
+
+func TestAuthCommand_oauth(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	verifier, err := NewJWTVerifier(keys.jwks())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := keys.sign(t, "ES256", "ec", map[string]interface{}{"sub": "john"})
+	b64 := base64.StdEncoding.EncodeToString
+
+	server := NewServer(Config{TokenVerifier: verifier}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	newServerClient := func() *Client {
+		c := newClient(backends.DummyAuthorizator{}, backends.DummyBackend{})
+		server.configureClient(c)
+		return c
+	}
+
+	sessionTest(t, newServerClient(), []sessionStep{
+		{"AUTH", "^\\+OK"},
+		{"", "^LOGIN\r\n$"},
+		{"", "^OAUTHBEARER\r\n$"},
+		{"", "^PLAIN\r\n$"},
+		{"", "^XOAUTH2\r\n$"},
+		{"", "^\\.\r\n$"},
+		{"AUTH XOAUTH2 " + b64([]byte("user=john\x01auth=Bearer "+token+"\x01\x01")), "^\\+OK User Successfully Logged on"},
+	})
+
+	sessionTest(t, newServerClient(), []sessionStep{
+		{"AUTH OAUTHBEARER " + b64([]byte("n,,\x01auth=Bearer "+token+"x\x01\x01")),
+			"^\\+ " + b64([]byte(`{"status":"invalid_token","schemes":"bearer"}`)) + "\r\n$"},
+		{"AQ==", "^-ERR \\[AUTH\\] Authentication failed"},
+	})
+
+	// context-aware verifier is preferred
+	var contexts []context.Context
+	server = NewServer(Config{TokenVerifier: tokenVerifier{}, TokenVerifierV2: contextAuthorizator{&contexts}},
+		backends.DummyAuthorizator{}, backends.DummyBackend{})
+	sessionTest(t, newServerClient(), []sessionStep{
+		{"AUTH XOAUTH2 " + b64([]byte("user=john\x01auth=Bearer any\x01\x01")), "^\\+OK User Successfully Logged on"},
+	})
+	if len(contexts) != 1 {
+		t.Errorf("Expected TokenVerifierV2 to be called once, but got %d calls", len(contexts))
+	}
+}
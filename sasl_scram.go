@@ -0,0 +1,256 @@
+package popgun
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// ScramCredentials are salted credentials of a user used by SCRAM mechanisms (RFC 5802).
+// Plaintext password doesn't need to be stored, see NewScramCredentials.
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// ScramAuthorizator is an optional interface of Authorizator. When implemented,
+// SCRAM-SHA-1 and SCRAM-SHA-256 mechanisms are enabled.
+type ScramAuthorizator interface {
+	// ScramCredentials returns salted credentials of given user for mechanism
+	// (SCRAM-SHA-1 or SCRAM-SHA-256), which differ in hash function used.
+	ScramCredentials(user, mechanism string) (exists bool, credentials ScramCredentials, err error)
+}
+
+// NewScramCredentials computes salted credentials for given password,
+// h is a hash function of the mechanism, e.g. sha256.New for SCRAM-SHA-256
+func NewScramCredentials(h func() hash.Hash, password string, salt []byte, iterations int) ScramCredentials {
+	saltedPassword := scramHi(h, []byte(password), salt, iterations)
+	clientKey := scramHmac(h, saltedPassword, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHmac(h, saltedPassword, []byte("Server Key")),
+	}
+}
+
+// scramHi is Hi() function of RFC 5802, i.e. PBKDF2 with output length of hash function
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func scramHmac(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramNonce generates server part of the nonce
+var scramNonce = func() string {
+	buf := make([]byte, 18)
+	rand.Read(buf)
+	return base64.StdEncoding.EncodeToString(buf)
+}
+
+// ScramMechanism implements SCRAM mechanism family without channel binding
+// (RFC 5802, RFC 7677) using ScramAuthorizator
+type ScramMechanism struct {
+	// Name of the mechanism, e.g. SCRAM-SHA-256
+	Name string
+	// Hash function of the mechanism, e.g. sha256.New
+	Hash func() hash.Hash
+}
+
+func (m ScramMechanism) Start(c *Client) SaslServer {
+	return &scramServer{ctx: c.ctx, mechanism: m, authorizator: scramExtension(c.authorizator)}
+}
+
+func (m ScramMechanism) Plaintext() bool {
+	return false
+}
+
+type scramServer struct {
+	ctx             context.Context
+	mechanism       ScramMechanism
+	authorizator    ScramAuthorizatorV2
+	step            int
+	user            string
+	gs2Header       string
+	nonce           string
+	clientFirstBare string
+	serverFirst     string
+	credentials     ScramCredentials
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	if s.authorizator == nil {
+		return nil, false, ErrAuthenticationFailed
+	}
+	switch s.step {
+	case 0:
+		if response == nil {
+			// client-first-message is expected as a response to empty challenge
+			return []byte{}, false, nil
+		}
+		s.step++
+		return s.clientFirst(string(response))
+	case 1:
+		s.step++
+		return s.clientFinal(string(response))
+	case 2:
+		s.step++
+		// client has verified server signature
+		if len(response) != 0 {
+			return nil, false, ErrInvalidSaslResponse
+		}
+		return nil, true, nil
+	}
+	return nil, false, ErrInvalidSaslResponse
+}
+
+func (s *scramServer) clientFirst(message string) ([]byte, bool, error) {
+	// gs2-header = gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		// channel binding is not supported
+		return nil, false, ErrAuthenticationFailed
+	}
+	var authzid string
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, ErrInvalidSaslResponse
+		}
+		var ok bool
+		if authzid, ok = scramDecodeName(parts[1][2:]); !ok {
+			return nil, false, ErrInvalidSaslResponse
+		}
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	// client-first-message-bare = "n=" saslname "," "r=" c-nonce ["," extensions]
+	attrs := strings.Split(s.clientFirstBare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	user, ok := scramDecodeName(attrs[0][2:])
+	if !ok || user == "" || len(attrs[1]) == 2 {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	if authzid != "" && authzid != user {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	exists, credentials, err := s.authorizator.ScramCredentials(s.ctx, user, s.mechanism.Name)
+	if err != nil {
+		return nil, false, err
+	}
+	if !exists {
+		return nil, false, ErrAuthenticationFailed
+	}
+	s.user = user
+	s.credentials = credentials
+	s.nonce = attrs[1][2:] + scramNonce()
+	s.serverFirst = "r=" + s.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) +
+		",i=" + strconv.Itoa(credentials.Iterations)
+
+	return []byte(s.serverFirst), false, nil
+}
+
+func (s *scramServer) clientFinal(message string) ([]byte, bool, error) {
+	// client-final-message = "c=" base64 "," "r=" nonce ["," extensions] "," "p=" proof
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrInvalidSaslResponse
+	}
+	if attrs[0][2:] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	if attrs[1][2:] != s.nonce {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	h := s.mechanism.Hash
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := scramHmac(h, s.credentials.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for j := range proof {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := h()
+	storedKey.Write(clientKey)
+	if subtle.ConstantTimeCompare(storedKey.Sum(nil), s.credentials.StoredKey) != 1 {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	serverSignature := scramHmac(h, s.credentials.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+func (s *scramServer) User() string {
+	return s.user
+}
+
+// scramDecodeName decodes saslname, where "," and "=" are encoded as "=2C" and "=3D"
+func scramDecodeName(name string) (string, bool) {
+	if !strings.Contains(name, "=") {
+		return name, true
+	}
+	var decoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			decoded.WriteByte(name[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name[i:], "=2C"):
+			decoded.WriteByte(',')
+		case strings.HasPrefix(name[i:], "=3D"):
+			decoded.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return decoded.String(), true
+}
@@ -0,0 +1,217 @@
+package popgun
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// scramAuthorizator computes SCRAM credentials from plaintext passwords
+type scramAuthorizator struct {
+	passwords  map[string]string
+	salt       string
+	iterations int
+}
+
+func (a scramAuthorizator) Authorize(user, pass string) bool {
+	return false
+}
+
+func (a scramAuthorizator) ScramCredentials(user, mechanism string) (bool, ScramCredentials, error) {
+	password, ok := a.passwords[user]
+	if !ok {
+		return false, ScramCredentials{}, nil
+	}
+	salt, err := base64.StdEncoding.DecodeString(a.salt)
+	if err != nil {
+		return false, ScramCredentials{}, err
+	}
+	h := sha1.New
+	if mechanism == "SCRAM-SHA-256" {
+		h = sha256.New
+	}
+	return true, NewScramCredentials(h, password, salt, a.iterations), nil
+}
+
+type scramTestCase struct {
+	name           string
+	salt           string
+	serverNonce    string
+	clientFirst    string
+	serverFirst    string
+	clientFinal    string
+	serverFinal    string
+	expectedErrors []error
+}
+
+func scramTest(t *testing.T, tc scramTestCase) {
+	defer func(f func() string) {
+		scramNonce = f
+	}(scramNonce)
+	scramNonce = func() string {
+		return tc.serverNonce
+	}
+
+	authorizator := scramAuthorizator{
+		passwords:  map[string]string{"user": "pencil"},
+		salt:       tc.salt,
+		iterations: 4096,
+	}
+	client := newClient(authorizator, backends.DummyBackend{})
+	server := client.saslMechanisms[tc.name].Start(client)
+
+	challenge, done, err := server.Next(nil)
+	if err != nil || done || len(challenge) != 0 {
+		t.Fatalf("Expected empty challenge, but got '%s', %v, %v", challenge, done, err)
+	}
+	steps := []struct{ response, expected string }{
+		{tc.clientFirst, tc.serverFirst},
+		{tc.clientFinal, tc.serverFinal},
+		{"", ""},
+	}
+	for i, step := range steps {
+		challenge, done, err := server.Next([]byte(step.response))
+		if i < len(tc.expectedErrors) && tc.expectedErrors[i] != nil {
+			if err != tc.expectedErrors[i] {
+				t.Errorf("%s: expected error '%v', but got '%v'", tc.name, tc.expectedErrors[i], err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if string(challenge) != step.expected {
+			t.Errorf("%s: expected '%s', but got '%s'", tc.name, step.expected, challenge)
+		}
+		if done != (i == len(steps)-1) {
+			t.Errorf("%s: unexpected done %v in step %d", tc.name, done, i)
+		}
+	}
+	if server.User() != "user" {
+		t.Errorf("%s: expected user 'user', but got '%s'", tc.name, server.User())
+	}
+}
+
+// test vectors from RFC 5802 section 5 and RFC 7677 section 3
+var scramSha1Vector = scramTestCase{
+	name:        "SCRAM-SHA-1",
+	salt:        "QSXCR+Q6sek8bf92",
+	serverNonce: "3rfcNHYJY1ZVvWVs7j",
+	clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+	serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+	clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+	serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+}
+
+var scramSha256Vector = scramTestCase{
+	name:        "SCRAM-SHA-256",
+	salt:        "W22ZaJ0SNY7soEsUEjb6gQ==",
+	serverNonce: "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0",
+	clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+	serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+	serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+}
+
+func TestScramMechanism(t *testing.T) {
+	scramTest(t, scramSha1Vector)
+	scramTest(t, scramSha256Vector)
+
+	//wrong proof
+	tc := scramSha256Vector
+	tc.clientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=AHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	tc.expectedErrors = []error{nil, ErrAuthenticationFailed}
+	scramTest(t, tc)
+
+	//wrong nonce
+	tc = scramSha1Vector
+	tc.clientFinal = "c=biws,r=fyko+d2lbbFgONRv9qkxdawL,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts="
+	tc.expectedErrors = []error{nil, ErrAuthenticationFailed}
+	scramTest(t, tc)
+
+	//channel binding is not supported
+	tc = scramSha1Vector
+	tc.clientFirst = "p=tls-unique,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"
+	tc.expectedErrors = []error{ErrAuthenticationFailed}
+	scramTest(t, tc)
+
+	//unknown user
+	tc = scramSha1Vector
+	tc.clientFirst = "n,,n=john,r=fyko+d2lbbFgONRv9qkxdawL"
+	tc.expectedErrors = []error{ErrAuthenticationFailed}
+	scramTest(t, tc)
+
+	//different authorization identity
+	tc = scramSha1Vector
+	tc.clientFirst = "n,a=admin,n=user,r=fyko+d2lbbFgONRv9qkxdawL"
+	tc.expectedErrors = []error{ErrAuthenticationFailed}
+	scramTest(t, tc)
+
+	//malformed message
+	tc = scramSha1Vector
+	tc.clientFirst = "n,,r=fyko+d2lbbFgONRv9qkxdawL"
+	tc.expectedErrors = []error{ErrInvalidSaslResponse}
+	scramTest(t, tc)
+}
+
+func TestNewScramCredentials(t *testing.T) {
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+	credentials := NewScramCredentials(sha1.New, "pencil", salt, 4096)
+	// StoredKey is not listed in RFC 5802, expected value was computed independently
+	expected := "6dlGYMOdZcOPutkcNY8U2g7vK9Y="
+	if got := base64.StdEncoding.EncodeToString(credentials.StoredKey); got != expected {
+		t.Errorf("Expected StoredKey '%s', but got '%s'", expected, got)
+	}
+	if credentials.Iterations != 4096 {
+		t.Errorf("Expected 4096 iterations, but got %d", credentials.Iterations)
+	}
+}
+
+func TestScramDecodeName(t *testing.T) {
+	testCases := []struct {
+		name     string
+		expected string
+		ok       bool
+	}{
+		{"user", "user", true},
+		{"us=2Cer", "us,er", true},
+		{"us=3Der=3D", "us=er=", true},
+		{"us=er", "", false},
+	}
+	for _, testCase := range testCases {
+		decoded, ok := scramDecodeName(testCase.name)
+		if decoded != testCase.expected || ok != testCase.ok {
+			t.Errorf("Expected '%s', %v, but got '%s', %v", testCase.expected, testCase.ok, decoded, ok)
+		}
+	}
+}
+
+func TestAuthCommand_scram(t *testing.T) {
+	defer func(f func() string) {
+		scramNonce = f
+	}(scramNonce)
+	scramNonce = func() string {
+		return scramSha1Vector.serverNonce
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	authorizator := scramAuthorizator{
+		passwords:  map[string]string{"user": "pencil"},
+		salt:       scramSha1Vector.salt,
+		iterations: 4096,
+	}
+	sessionTest(t, newClient(authorizator, backends.DummyBackend{}), []sessionStep{
+		{"AUTH", "^\\+OK"},
+		{"", "^LOGIN\r\n$"},
+		{"", "^PLAIN\r\n$"},
+		{"", "^SCRAM-SHA-1\r\n$"},
+		{"", "^SCRAM-SHA-256\r\n$"},
+		{"", "^\\.\r\n$"},
+		{"AUTH SCRAM-SHA-1 " + b64([]byte(scramSha1Vector.clientFirst)), "^\\+ " + b64([]byte(scramSha1Vector.serverFirst)) + "\r\n$"},
+		{b64([]byte(scramSha1Vector.clientFinal)), "^\\+ " + b64([]byte(scramSha1Vector.serverFinal)) + "\r\n$"},
+		{"\r", "^\\+OK User Successfully Logged on"},
+	})
+}
@@ -0,0 +1,85 @@
+package popgun
+
+import (
+	"testing"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+func TestPlainMechanism(t *testing.T) {
+	authorizator := secretAuthorizator{"john": "secret"}
+	testCases := []struct {
+		response    string
+		expectedErr error
+	}{
+		{"\x00john\x00secret", nil},
+		{"john\x00john\x00secret", nil},
+		{"admin\x00john\x00secret", ErrAuthenticationFailed},
+		{"\x00john\x00wrong", ErrAuthenticationFailed},
+		{"\x00john", ErrInvalidSaslResponse},
+		{"", ErrInvalidSaslResponse},
+	}
+	for _, testCase := range testCases {
+		client := newClient(authorizator, backends.DummyBackend{})
+		server := PlainMechanism{}.Start(client)
+		_, done, err := server.Next([]byte(testCase.response))
+		if err != testCase.expectedErr {
+			t.Errorf("Response %q: expected error '%v', but got '%v'", testCase.response, testCase.expectedErr, err)
+		}
+		if testCase.expectedErr == nil && (!done || server.User() != "john") {
+			t.Errorf("Response %q: expected user 'john' to be authenticated", testCase.response)
+		}
+	}
+}
+
+func TestAuthCommand_continuation(t *testing.T) {
+	authorizator := secretAuthorizator{"john": "secret"}
+
+	//PLAIN without initial response
+	sessionTest(t, newClient(authorizator, backends.DummyBackend{}), []sessionStep{
+		{"AUTH PLAIN", "^\\+ \r\n$"},
+		{"AGpvaG4Ac2VjcmV0", "^\\+OK User Successfully Logged on"},
+	})
+
+	//LOGIN without initial response
+	sessionTest(t, newClient(authorizator, backends.DummyBackend{}), []sessionStep{
+		{"AUTH LOGIN", "^\\+ VXNlcm5hbWU6\r\n$"},
+		{"am9obg==", "^\\+ UGFzc3dvcmQ6\r\n$"},
+		{"c2VjcmV0", "^\\+OK User Successfully Logged on"},
+	})
+
+	//LOGIN with initial response and wrong password
+	sessionTest(t, newClient(authorizator, backends.DummyBackend{}), []sessionStep{
+		{"AUTH LOGIN am9obg==", "^\\+ UGFzc3dvcmQ6\r\n$"},
+		{"d3Jvbmc=", "^-ERR \\[AUTH\\] Authentication failed"},
+		{"STAT", "^-ERR Error executing command STAT"},
+	})
+
+	//cancelled exchange
+	sessionTest(t, newClient(authorizator, backends.DummyBackend{}), []sessionStep{
+		{"AUTH LOGIN", "^\\+ VXNlcm5hbWU6\r\n$"},
+		{"*", "^-ERR Authentication cancelled"},
+		{"AUTH PLAIN", "^\\+ \r\n$"},
+		{"not base64!", "^-ERR Invalid base64 data"},
+	})
+}
+
+type testMechanism struct{}
+
+func (m testMechanism) Start(c *Client) SaslServer {
+	return &plainServer{authorize: func(user, pass string) (bool, error) {
+		return user == "test" && pass == "test", nil
+	}}
+}
+
+func (m testMechanism) Plaintext() bool {
+	return false
+}
+
+func TestServer_RegisterSaslMechanism(t *testing.T) {
+	server := NewServer(Config{}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	server.RegisterSaslMechanism("x-test", testMechanism{})
+	if _, ok := server.saslMechanisms["X-TEST"]; !ok {
+		t.Error("Expected X-TEST mechanism to be registered")
+	}
+}
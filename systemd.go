@@ -0,0 +1,85 @@
+package popgun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdListenFdsStart is the first file descriptor passed by systemd
+var systemdListenFdsStart = 3
+
+// SystemdListener is a listening socket passed by systemd socket activation
+type SystemdListener struct {
+	net.Listener
+	// Name is the socket name set by FileDescriptorName= in the socket unit,
+	// "unknown" when not set
+	Name string
+}
+
+// SystemdListeners returns listening sockets passed by systemd (LISTEN_FDS, LISTEN_PID
+// and LISTEN_FDNAMES environment variables). Nil is returned when the process was not
+// socket activated. The environment variables are unset, so they are not inherited
+// by child processes.
+func SystemdListeners() ([]SystemdListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make([]SystemdListener, 0, count)
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		fd := systemdListenFdsStart + i
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("socket %s (fd %d) is not a listener: %v", name, fd, err)
+		}
+		listeners = append(listeners, SystemdListener{Listener: listener, Name: name})
+	}
+	return listeners, nil
+}
+
+// ServeSystemd serves clients on sockets passed by systemd socket activation instead of
+// listening on configured interfaces. Configuration of every socket (TLS mode, banner
+// and auth policy) is looked up by its name in listeners, defaults are used for sockets
+// not found there. Like ListenAndServe, it blocks until the server is shut down.
+func (s *Server) ServeSystemd(listeners map[string]ListenerConfig) error {
+	systemdListeners, err := SystemdListeners()
+	if err != nil {
+		return err
+	}
+	if len(systemdListeners) == 0 {
+		return errors.New("no sockets passed by systemd")
+	}
+	configs := make(map[net.Listener]ListenerConfig)
+	for _, l := range systemdListeners {
+		configs[l.Listener] = listeners[l.Name]
+	}
+	return s.serveAll(configs)
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package popgun
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DevelHell/popgun/backends"
+)
+
+// passSockets creates listening sockets and passes them to the process the same way
+// systemd does, returns their addresses
+func passSockets(t *testing.T, names ...string) []string {
+	const fdsStart = 100
+	start := systemdListenFdsStart
+	systemdListenFdsStart = fdsStart
+	t.Cleanup(func() { systemdListenFdsStart = start })
+
+	var addrs []string
+	for i := range names {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Dup3(int(f.Fd()), fdsStart+i, 0); err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, l.Addr().String())
+		f.Close()
+		l.Close()
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(len(names)))
+	t.Setenv("LISTEN_FDNAMES", strings.Join(names, ":"))
+	return addrs
+}
+
+func TestSystemdListeners(t *testing.T) {
+	addrs := passSockets(t, "pop3", "")
+	listeners, err := SystemdListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listeners) != 2 {
+		t.Fatalf("Expected 2 listeners, but got %d", len(listeners))
+	}
+	for i, name := range []string{"pop3", "unknown"} {
+		if listeners[i].Name != name {
+			t.Errorf("Expected listener name '%s', but got '%s'", name, listeners[i].Name)
+		}
+		if listeners[i].Addr().String() != addrs[i] {
+			t.Errorf("Expected listener on '%s', but got '%s'", addrs[i], listeners[i].Addr())
+		}
+		listeners[i].Close()
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("Expected LISTEN_FDS to be unset")
+	}
+}
+
+func TestSystemdListeners_OtherProcess(t *testing.T) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := SystemdListeners()
+	if err != nil || listeners != nil {
+		t.Errorf("Expected no listeners, but got %v, %v", listeners, err)
+	}
+}
+
+func TestServer_ServeSystemd(t *testing.T) {
+	addrs := passSockets(t, "pop3", "pop3s")
+	cfg := Config{TLSConfig: &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}}
+	server := NewServer(cfg, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	served := make(chan error)
+	go func() {
+		served <- server.ServeSystemd(map[string]ListenerConfig{"pop3s": {TLSMode: TLSModeImplicit}})
+	}()
+
+	conn, err := net.DialTimeout("tcp", addrs[0], time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	sessionSteps(t, conn, reader, []sessionStep{
+		{"", "^\\+OK"},
+		{"CAPA", "^\\+OK"},
+	})
+	if capa := readMultiLine(t, reader); !strings.Contains(capa, "STLS") {
+		t.Errorf("Expected STLS on plaintext socket, but got %q", capa)
+	}
+
+	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addrs[1],
+		&tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Expected TLS on 'pop3s' socket, but got %v", err)
+	}
+	defer tlsConn.Close()
+	sessionSteps(t, tlsConn, bufio.NewReader(tlsConn), []sessionStep{{"", "^\\+OK"}})
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed, but got %v", err)
+	}
+}
+
+func TestServer_ServeSystemdWithoutSockets(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	server := NewServer(Config{}, backends.DummyAuthorizator{}, backends.DummyBackend{})
+	if err := server.ServeSystemd(nil); err == nil {
+		t.Error("Expected error when no sockets are passed")
+	}
+}